@@ -2,8 +2,11 @@
 AnyStore is a thread-safe key/value store utilizing map[any]any in the
 background with atomic.Value on read and mutex locks on write for
 performance. The AnyStore map can optionally be persisted to disk as
-an AES-128/192/256 encrypted GOB file with HMAC-SHA256 for
-authentication and validation of the data. For access from multiple
+a GOB file (or another Codec) encrypted and authenticated using
+AES-256-GCM with keys derived from the 16, 24 or 32 byte master key
+using HKDF-SHA256. The file starts with a versioned header (magic
+"ANYE") recording how it was written, files in the legacy AES-CFB with
+HMAC-SHA256 format are still read. For access from multiple
 instances sharing the same map, POSIX syscall.Flock is used to
 exclusively lock a lockfile during save. There is no support for
 Windows or other non-POSIX systems missing flock(2).
@@ -134,10 +137,12 @@ variables, using Stash, Unstash and EditThing is simple...
 package anystore
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -147,12 +152,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
-	"strings"
+	"reflect"
 	"sync"
 	"sync/atomic"
-	"syscall"
+	"time"
 )
 
 const DefaultEncryptionKey string = "cTAvflqncVmYD7bLM31fP3TVuwEoosMMwehpIwn1P84"
@@ -163,6 +166,7 @@ var (
 	ErrKeyLength            error = errors.New("key length must be 16, 24 or 32 (for AES-128, AES-192 or AES-256)")
 	ErrWroteTooLittle       error = errors.New("wrote too few bytes")
 	ErrHMACValidationFailed error = errors.New("HMAC validation failed (corrupt data or wrong encryption key)")
+	ErrNotComparable        error = errors.New("old value is not of a comparable type")
 )
 
 // A thread-safe key/value store using string as key and interface{} (any) as
@@ -178,7 +182,18 @@ type AnyStore interface {
 
 	SetEncryptionKey(key string) (AnyStore, error)
 
-	// GetEncryptionKeyBytes returns a byte slice with the AES encryption key.
+	// Rekey re-encrypts the persistence file, encrypted with oldKey, using
+	// newKey and sets newKey as the encryption key of the store. The file is
+	// read, re-encrypted and atomically replaced (temporary file and rename)
+	// while holding the lock, concurrent readers see either the old or the new
+	// file. An append-only log is replaced by a compacted log. Keys are 16, 24
+	// or 32 byte base64-encoded strings. If persistence is disabled, Rekey only
+	// sets newKey. See also RekeyFile.
+	Rekey(oldKey, newKey string) error
+
+	// GetEncryptionKeyBytes returns a copy of the AES encryption key (the
+	// master key). If the store uses a passphrase, the key derived from it is
+	// returned. The caller should zero the copy after use (see Secret).
 	GetEncryptionKeyBytes() []byte
 
 	// HasKey tests if key exists in the store, returns true if it does, false if
@@ -193,16 +208,72 @@ type AnyStore interface {
 	// and more costly than Load or HasKey.
 	Store(key any, value any) error
 
+	// StoreWithTTL adds or replaces a key/value pair in the store that expires
+	// after ttl. Expired keys are invisible to Load, HasKey, Keys, Len, etc and
+	// are purged from the persistence file on the next write. A ttl of zero
+	// uses Options.DefaultTTL, a negative ttl stores the value without expiry.
+	StoreWithTTL(key any, value any, ttl time.Duration) error
+
 	// Delete removes a key from the store. Operation uses sync.Mutex and is
 	// locking.
 	Delete(key any) error
 
+	// CompareAndSwap swaps the old and new values for key if the value stored
+	// in the store is equal to old. The old value must be of a comparable type
+	// or ErrNotComparable is returned. If persistence is enabled, the operation
+	// is a single flock-protected read-modify-write of the persistence file.
+	CompareAndSwap(key, old, new any) (swapped bool, err error)
+
+	// CompareAndDelete deletes the entry for key if its value is equal to old.
+	// The old value must be of a comparable type or ErrNotComparable is
+	// returned. If there is no current value for key, CompareAndDelete returns
+	// false.
+	CompareAndDelete(key, old any) (deleted bool, err error)
+
+	// LoadOrStore returns the existing value for key if present. Otherwise, it
+	// stores and returns the given value. The loaded result is true if the
+	// value was loaded, false if stored.
+	LoadOrStore(key, value any) (actual any, loaded bool, err error)
+
+	// LoadAndDelete deletes the value for key, returning the previous value if
+	// any. The loaded result reports whether key was present.
+	LoadAndDelete(key any) (value any, loaded bool, err error)
+
+	// Swap stores value for key and returns the previous value if any. The
+	// loaded result reports whether key was present.
+	Swap(key, value any) (previous any, loaded bool, err error)
+
+	// StoreMany adds or replaces all key/value pairs in kv. If persistence is
+	// enabled, the persistence file is saved once for the entire batch.
+	StoreMany(kv map[any]any) error
+
+	// DeleteMany removes all keys from the store. If persistence is enabled,
+	// the persistence file is saved once for the entire batch.
+	DeleteMany(keys []any) error
+
+	// Apply executes a batch of store and delete operations in order. Either
+	// all operations are applied or none (if an operation is invalid). If
+	// persistence is enabled, the persistence file is saved once.
+	Apply(ops []Op) error
+
 	// Len returns number of keys in the store.
 	Len() (int, error)
 
 	// Returns a slice with all keys in the store.
 	Keys() ([]any, error)
 
+	// Range calls f sequentially for each key and value in the store. If f
+	// returns false, Range stops the iteration. All keys and values come from
+	// the same version of the store (loaded once from the persistence file if
+	// persistence is enabled). The store is not locked while f is executing, f
+	// can therefore safely call methods on the store, but changes are not
+	// reflected in the ongoing iteration.
+	Range(f func(key, value any) bool) error
+
+	// Snapshot returns an immutable read-only view of the store. If persistence
+	// is enabled, the persistence file is loaded once.
+	Snapshot() (*Snapshot, error)
+
 	// Run executes function atomicOperation exclusively by locking the store.
 	// atomicOperation is intended to be an inline function running a set of
 	// operations on the store in an exclusive scope. BEWARE! You have to use the
@@ -214,12 +285,51 @@ type AnyStore interface {
 	// passed to atomicOperation). Technically, you could use the original HasKey,
 	// Load and Len as they are non-locking and mere duplicates in the wrapped
 	// instance, but that could cause confusion. The error returned by the passed
-	// function is returned by Run.
+	// function is returned by Run. Run only locks the store in-process, each
+	// Store or Delete is persisted separately. Use Update for a transaction
+	// that is atomic across processes.
 	Run(atomicOperation func(s AnyStore) error) error
 
-	// If persistence is enabled, Close removes the lockfile.
+	// Update executes transaction in a read-write transaction. The store is
+	// locked and, if persistence is enabled, the lockfile is exclusively
+	// flocked for the entire duration of the transaction making it atomic
+	// across processes. All changes made through the AnyStore passed to
+	// transaction (tx) are staged in memory and persisted with a single atomic
+	// rename only if transaction returns nil. If transaction returns an error,
+	// all changes are discarded and the error is returned by Update. Like Run,
+	// you have to use tx and not the origin instance or Update will deadlock.
+	// tx is an ephemeral in-memory store, persistence settings changed on tx
+	// have no effect on the origin instance.
+	Update(transaction func(tx AnyStore) error) error
+
+	// Compact rewrites the persistence file into a fresh snapshot (using a
+	// temporary file and rename) purging expired keys. In append-only mode
+	// (Options.AppendOnly), the log is replaced by a new log starting with the
+	// snapshot. Compact is a no-op if persistence is disabled.
+	Compact() error
+
+	// Watch returns a channel receiving an Event for every change to keys (or
+	// to any key if no keys are given) until ctx is done or the store is
+	// closed, after which the channel is closed. Changes made in-process are
+	// delivered immediately. If persistence is enabled, the persistence file is
+	// also checked for changes made by other processes every
+	// Options.WatchInterval. Events are queued and never dropped, a slow
+	// receiver does not block the store. Events describe changes to the map,
+	// storing a value deeply equal (reflect.DeepEqual) to the current value
+	// of the key is not a change and emits no Event.
+	Watch(ctx context.Context, keys ...any) <-chan Event
+
+	// If persistence is enabled, Close removes the lockfile. Close also stops
+	// all watchers.
 	Close() error
 
+	// Wipe zeroes the key material held by the store (the key, keys derived
+	// from a passphrase and data keys unwrapped by a KeyProvider), unsets the
+	// key and drops the cached decoded persistence. The store can not encrypt
+	// or decrypt until a new key is set (e.g using SetEncryptionKey). A
+	// Keyring is owned by the caller and not wiped (see Keyring.Wipe).
+	Wipe()
+
 	load() error
 
 	loadStoreAndSave(key any, value any, remove bool) error
@@ -231,21 +341,112 @@ type Options struct {
 	// Can start with tilde for HOME resolution, will do os.MkdirAll on directory
 	// path. Omit to use DefaultPersistenceFile
 	PersistenceFile string
+	// Storage of the persisted store, overrides PersistenceFile. Omit to use
+	// a file Backend (see NewFileBackend) with PersistenceFile.
+	Backend Backend
 	// 16, 24 or 32 byte base64-encoded string (omit to use the default key ==
 	// insecure)
 	EncryptionKey string
-	// If true, the serialized output (GOB) will be gzipped before encrypted and
-	// saved to disk and vice versa for loading from the persistence.
+	// If not empty, the encryption key is derived from Passphrase using
+	// PBKDF2-SHA256 with a random salt and the iteration count recorded in the
+	// header of the persistence file. EncryptionKey is ignored.
+	Passphrase string
+	// Number of PBKDF2 iterations when deriving the key from Passphrase for new
+	// data. Omit (or 0) to use DefaultPassphraseIterations. Existing data is
+	// decrypted using the iteration count recorded in it.
+	PassphraseIterations int
+	// If not nil, data is encrypted using the primary key of Keyring and
+	// decrypted using the key recorded in the header of the persistence file
+	// (see Keyring). Overrides Passphrase and EncryptionKey.
+	Keyring *Keyring
+	// If not nil, use envelope encryption: data is encrypted using a random
+	// data key wrapped by KeyProvider and stored in the header of the
+	// persistence file (see KeyProvider). Overrides Keyring, Passphrase and
+	// EncryptionKey.
+	KeyProvider KeyProvider
+	// If not empty, data is encrypted using a random file key encrypted to
+	// each X25519 public key in Recipients (see NewKeyPair). Overrides
+	// Keyring, Passphrase and EncryptionKey.
+	Recipients []*ecdh.PublicKey
+	// X25519 private key used to decrypt data encrypted to Recipients. If
+	// Recipients is empty, new data is encrypted to the recipients of the
+	// persistence file (or to Identity if there is no file yet).
+	Identity *ecdh.PrivateKey
+	// If true, using the publicly known DefaultEncryptionKey (no key given or
+	// the default key given explicitly) returns ErrDefaultKeyInUse, see also
+	// SetStrictMode.
+	RequireExplicitKey bool
+	// Encryption of persisted data, omit to use EncryptionAESGCM. With
+	// EncryptionNone the persistence file is written unencrypted (but
+	// checksummed using SHA-256) and encrypted files are refused, no key may
+	// be given.
+	Encryption Encryption
+	// Codec serializing the persisted map, omit to use GobCodec. The codec is
+	// recorded in the header of the persistence file, existing files are read
+	// using the codec they were written with (see Codec).
+	Codec Codec
+	// If true, the serialized output (e.g GOB) will be gzipped before encrypted
+	// and saved to disk (same as Compression gzip). The compression is
+	// recorded in the header of the persistence file, loading decompresses
+	// according to it regardless of this option.
 	GZipPersistenceFile bool
+	// Compression of persisted data (CompressionNone, CompressionGzip,
+	// CompressionZlib or CompressionFlate), overrides GZipPersistenceFile.
+	// Omit to use gzip if GZipPersistenceFile is true, none otherwise.
+	// Switching algorithm never makes existing files unreadable.
+	Compression Compression
+	// Compression level (compress/flate levels, 1 is best speed, 9 best
+	// compression, -2 Huffman only). Omit (or 0) to use the default level.
+	CompressionLevel int
+	// If above zero, keys stored without an explicit TTL (e.g via Store) expire
+	// after DefaultTTL. Omit (or 0) to never expire keys by default.
+	DefaultTTL time.Duration
+	// If true, each change is appended to the persistence file as an encrypted
+	// and authenticated record instead of rewriting the entire file. Loading
+	// replays the log. See AnyStore.Compact.
+	AppendOnly bool
+	// Number of records appended to the log before it is automatically
+	// compacted into a fresh snapshot. Omit (or 0) to use
+	// DefaultCompactThreshold, a negative value disables automatic compaction.
+	CompactThreshold int
+	// How often to check the persistence file for changes made by other
+	// processes while there are active watchers (see AnyStore.Watch). Omit to
+	// use DefaultWatchInterval.
+	WatchInterval time.Duration
+	// If true, loading the persistence file is done holding a shared lock
+	// (LOCK_SH on the lockfile of the default file backend) while writers hold
+	// the exclusive lock. Readers in other processes then never read while a
+	// writer is saving, replacing or removing files. Only applies to backends
+	// implementing SharedLockBackend, others are read without a lock.
+	SharedReadLock bool
 }
 
 type anyStore struct {
-	mutex    sync.Mutex
-	kv       atomic.Value
-	persist  atomic.Bool
-	gzip     atomic.Bool
-	key      atomic.Value
-	savefile atomic.Value
+	mutex   sync.Mutex
+	kv      atomic.Value
+	persist atomic.Bool
+	key     atomic.Value
+	backend atomic.Value
+	ttl     atomic.Int64
+	cache   atomic.Value
+
+	// plaintext is true with EncryptionNone.
+	plaintext atomic.Bool
+	// explicitKey is Options.RequireExplicitKey.
+	explicitKey atomic.Bool
+	// codec is Options.Codec, nil for GobCodec.
+	codec Codec
+	// compression and compressionLevel of new data.
+	compression      Compression
+	compressionLevel int
+
+	appendOnly       atomic.Bool
+	compactThreshold atomic.Int64
+	// sharedReadLock is Options.SharedReadLock.
+	sharedReadLock atomic.Bool
+
+	watch         watchHub
+	watchInterval atomic.Int64
 }
 
 // Implements AnyStore and "overrides" Store, Delete and Run.
@@ -264,12 +465,19 @@ func init() {
 
 // NewAnyStore returns an initialized AnyStore.
 func NewAnyStore(o *Options) (AnyStore, error) {
+	return newAnyStore(o)
+}
+
+// newAnyStore implements NewAnyStore returning the concrete type.
+func newAnyStore(o *Options) (*anyStore, error) {
 	a := new(anyStore)
 	if o == nil {
 		o = &Options{}
 	}
 	if o.EnablePersistence {
-		if o.PersistenceFile != "" {
+		if o.Backend != nil {
+			a.setStorage(o.Backend)
+		} else if o.PersistenceFile != "" {
 			if _, err := a.SetPersistenceFile(o.PersistenceFile); err != nil {
 				return a, err
 			}
@@ -282,16 +490,50 @@ func NewAnyStore(o *Options) (AnyStore, error) {
 	} else {
 		a.persist.Store(false)
 	}
-	if o.GZipPersistenceFile {
-		a.gzip.Store(true)
-	} else {
-		a.gzip.Store(false)
+	compression, level, err := parseCompression(o.Compression, o.GZipPersistenceFile, o.CompressionLevel)
+	if err != nil {
+		return a, err
 	}
-	if o.EncryptionKey != "" {
+	a.compression, a.compressionLevel = compression, level
+	a.ttl.Store(int64(o.DefaultTTL))
+	a.appendOnly.Store(o.AppendOnly)
+	a.compactThreshold.Store(int64(o.CompactThreshold))
+	a.sharedReadLock.Store(o.SharedReadLock)
+	a.watchInterval.Store(int64(o.WatchInterval))
+	a.explicitKey.Store(o.RequireExplicitKey)
+	a.codec = o.Codec
+	plaintext, err := parseEncryption(o.Encryption)
+	if err != nil {
+		return a, err
+	}
+	a.plaintext.Store(plaintext)
+	if plaintext {
+		if o.EncryptionKey != "" || o.Passphrase != "" || o.Keyring != nil || o.KeyProvider != nil || len(o.Recipients) > 0 || o.Identity != nil {
+			return a, ErrKeyWithEncryptionNone
+		}
+		a.kv.Store(make(anyMap))
+		return a, nil
+	}
+	if o.KeyProvider != nil {
+		a.setKeys(newEnvelopeKey(o.KeyProvider))
+	} else if len(o.Recipients) > 0 || o.Identity != nil {
+		a.setKeys(newRecipientsKey(o.Recipients, o.Identity))
+	} else if o.Keyring != nil {
+		a.setKeys(o.Keyring)
+	} else if o.Passphrase != "" {
+		keys, err := newPassphraseKey(o.Passphrase, o.PassphraseIterations)
+		if err != nil {
+			return a, err
+		}
+		a.setKeys(keys)
+	} else if o.EncryptionKey != "" {
 		if _, err := a.SetEncryptionKey(o.EncryptionKey); err != nil {
 			return a, err
 		}
 	} else {
+		if a.requireExplicitKey() {
+			return a, fmt.Errorf("%w: no encryption key given", ErrDefaultKeyInUse)
+		}
 		if _, err := a.SetEncryptionKey(DefaultEncryptionKey); err != nil {
 			return a, err
 		}
@@ -301,36 +543,11 @@ func NewAnyStore(o *Options) (AnyStore, error) {
 }
 
 func (a *anyStore) SetPersistenceFile(file string) (AnyStore, error) {
-	// If persistence file starts with a tilde, resolve it to the user's home
-	// directory.
-	if strings.HasPrefix(file, "~/") {
-		dirname, err := os.UserHomeDir()
-		if err != nil {
-			return a, err
-		}
-		file = filepath.Join(dirname, file[2:])
-	}
-	dir, _ := filepath.Split(file)
-
-	if dir != "" && dir != "." && dir != ".." {
-		if _, err := os.Stat(dir); err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				if err := os.MkdirAll(dir, 0777); err != nil {
-					return a, err
-				}
-			}
-		}
-	}
-
-	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	backend, err := NewFileBackend(file)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return a, err
-		}
-	} else {
-		f.Close()
+		return a, err
 	}
-	a.savefile.Store(file)
+	a.setStorage(backend)
 	return a, nil
 }
 
@@ -345,21 +562,24 @@ func (a *anyStore) DisablePersistence() AnyStore {
 }
 
 func (a *anyStore) SetEncryptionKey(key string) (AnyStore, error) {
-	binkey, err := base64.RawStdEncoding.DecodeString(key)
+	binkey, err := a.decodeExplicitKey(key)
 	if err != nil {
 		return a, err
 	}
-	switch len(binkey) {
-	case 16, 24, 32:
-	default:
-		return a, ErrKeyLength
-	}
-	a.key.Store(binkey)
+	a.setKeys(binkey)
 	return a, nil
 }
 
 func (a *anyStore) GetEncryptionKeyBytes() []byte {
-	return a.key.Load().([]byte)
+	keys, err := a.keys()
+	if err != nil {
+		return nil
+	}
+	key := keys.bytes()
+	if key == nil {
+		return nil
+	}
+	return bytes.Clone(key)
 }
 
 func (a *anyStore) HasKey(key any) bool {
@@ -369,7 +589,7 @@ func (a *anyStore) HasKey(key any) bool {
 		a.load()
 	}
 	kv := a.kv.Load().(anyMap)
-	_, ok := kv[key]
+	_, ok := kv.load(key, time.Now().UnixNano())
 	return ok
 }
 
@@ -383,22 +603,23 @@ func (a *anyStore) Load(key any) (any, error) {
 		}
 	}
 	kv := a.kv.Load().(anyMap)
-	return kv[key], nil
+	value, _ := kv.load(key, time.Now().UnixNano())
+	return value, nil
 }
 
 func (a *anyStore) Store(key any, value any) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	if a.persist.Load() {
-		return a.loadStoreAndSave(key, value, false)
+		return a.loadStoreAndSave(key, a.expiring(value, 0), false)
 	}
 	kvO := a.kv.Load().(anyMap)
 	kvN := make(anyMap)
 	for k, v := range kvO {
 		kvN[k] = v
 	}
-	kvN[key] = value
-	a.kv.Store(kvN)
+	kvN[key] = a.expiring(value, 0)
+	a.setKV(kvN)
 	return nil
 }
 
@@ -414,10 +635,40 @@ func (a *anyStore) Delete(key any) error {
 		kvN[k] = v
 	}
 	delete(kvN, key)
-	a.kv.Store(kvN)
+	a.setKV(kvN)
 	return nil
 }
 
+func (a *anyStore) CompareAndSwap(key, old, new any) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.compareAndSwap(key, old, new)
+}
+
+func (a *anyStore) CompareAndDelete(key, old any) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.compareAndDelete(key, old)
+}
+
+func (a *anyStore) LoadOrStore(key, value any) (any, bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.loadOrStore(key, value)
+}
+
+func (a *anyStore) LoadAndDelete(key any) (any, bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.loadAndDelete(key)
+}
+
+func (a *anyStore) Swap(key, value any) (any, bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.swap(key, value)
+}
+
 func (a *anyStore) Len() (int, error) {
 	if a.persist.Load() {
 		a.mutex.Lock()
@@ -426,7 +677,7 @@ func (a *anyStore) Len() (int, error) {
 			return 0, err
 		}
 	}
-	return len(a.kv.Load().(anyMap)), nil
+	return a.kv.Load().(anyMap).len(time.Now().UnixNano()), nil
 }
 
 func (a *anyStore) Keys() ([]any, error) {
@@ -440,13 +691,31 @@ func (a *anyStore) Keys() ([]any, error) {
 	keys := make([]any, 0)
 	kv, ok := a.kv.Load().(anyMap)
 	if ok {
-		for k, _ := range kv {
-			keys = append(keys, k)
-		}
+		keys = kv.keys(time.Now().UnixNano())
 	}
 	return keys, nil
 }
 
+func (a *anyStore) Range(f func(key, value any) bool) error {
+	snapshot, err := a.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.Range(f)
+	return nil
+}
+
+func (a *anyStore) Snapshot() (*Snapshot, error) {
+	if a.persist.Load() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+	return &Snapshot{kv: a.kv.Load().(anyMap), now: time.Now().UnixNano()}, nil
+}
+
 func (a *anyStore) Run(atomicOperation func(s AnyStore) error) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
@@ -455,219 +724,484 @@ func (a *anyStore) Run(atomicOperation func(s AnyStore) error) error {
 }
 
 func (a *anyStore) Close() error {
+	a.watch.close()
 	if a.persist.Load() {
 		// Lock the store
 		a.mutex.Lock()
 		defer a.mutex.Unlock()
-		file, ok := a.savefile.Load().(string)
-		if !ok {
-			return errors.New("persistence not set")
-		}
-		lockfile := file + ".lock"
-		_, err := os.Stat(lockfile)
+		backend, err := a.storage()
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return nil
-			}
 			return err
 		}
-		if err := os.Remove(lockfile); err != nil {
+		return backend.Close()
+	}
+	return nil
+}
+
+func (a *anyStore) load() error {
+	backend, err := a.storage()
+	if err != nil {
+		return err
+	}
+	// load is never called holding the exclusive lock, the shared lock can
+	// not deadlock with it.
+	if shared, ok := backend.(SharedLockBackend); ok && a.sharedReadLock.Load() {
+		if err := shared.RLock(); err != nil {
 			return err
 		}
+		defer shared.RUnlock()
+	}
+	kvN, err := a.readPersistence(backend)
+	if err != nil {
+		return err
+	}
+	if kvO, ok := a.kv.Load().(anyMap); ok && sameMap(kvO, kvN) {
+		// Persistence file has not changed since last load.
+		return nil
 	}
+	a.setKV(kvN)
 	return nil
 }
 
-func (a *anyStore) load() error {
-	file, ok := a.savefile.Load().(string)
-	if !ok {
-		return errors.New("no persistence file set")
+// mutator modifies kv in place and reports whether kv was changed. If the
+// mutator returns an error or changed == false, nothing is saved.
+type mutator func(kv anyMap) (changed bool, err error)
+
+// mutate applies modify to a copy of the current map and stores the result.
+// If persistence is enabled, the persistence file is loaded, modified and
+// saved in a single flock-protected read-modify-write making the operation
+// atomic across processes. mutate does not lock the store, caller must hold
+// a.mutex.
+func (a *anyStore) mutate(modify mutator) error {
+	if a.persist.Load() {
+		return a.loadModifyAndSave(modify)
 	}
-	encryptionKey, ok := a.key.Load().([]byte)
-	if !ok {
-		return errors.New("encryption key not set")
-	}
-	// lockfile := file + ".lock"
-	// lockfd, err := syscall.Open(lockfile, syscall.O_CREAT|syscall.O_RDWR, 0666)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer syscall.Close(lockfd)
-	// if err := syscall.Flock(lockfd, syscall.LOCK_EX); err != nil {
-	// 	return err
-	// }
-	data := []byte{}
-	f, err := os.OpenFile(file, os.O_RDONLY, 0666)
+	kvO := a.kv.Load().(anyMap)
+	kvN := make(anyMap, len(kvO))
+	for k, v := range kvO {
+		kvN[k] = v
+	}
+	changed, err := modify(kvN)
+	if err != nil || !changed {
+		return err
+	}
+	kvN.purge(time.Now().UnixNano())
+	a.setKV(kvN)
+	return nil
+}
+
+// compareAndSwap, compareAndDelete, loadOrStore, loadAndDelete and swap are
+// the non-locking implementations used by both anyStore and unsafeAnyStore.
+
+func (a *anyStore) compareAndSwap(key, old, new any) (bool, error) {
+	if !isComparable(old) {
+		return false, ErrNotComparable
+	}
+	swapped := false
+	err := a.mutate(func(kv anyMap) (bool, error) {
+		current, ok := kv.load(key, time.Now().UnixNano())
+		if !ok || !equal(current, old) {
+			return false, nil
+		}
+		kv[key] = a.expiring(new, 0)
+		swapped = true
+		return true, nil
+	})
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return err
+		return false, err
+	}
+	return swapped, nil
+}
+
+func (a *anyStore) compareAndDelete(key, old any) (bool, error) {
+	if !isComparable(old) {
+		return false, ErrNotComparable
+	}
+	deleted := false
+	err := a.mutate(func(kv anyMap) (bool, error) {
+		current, ok := kv.load(key, time.Now().UnixNano())
+		if !ok || !equal(current, old) {
+			return false, nil
 		}
-	} else {
-		data, err = io.ReadAll(f)
-		f.Close()
-		if err != nil {
+		delete(kv, key)
+		deleted = true
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+func (a *anyStore) loadOrStore(key, value any) (any, bool, error) {
+	actual := value
+	loaded := false
+	err := a.mutate(func(kv anyMap) (bool, error) {
+		if current, ok := kv.load(key, time.Now().UnixNano()); ok {
+			actual = current
+			loaded = true
+			return false, nil
+		}
+		kv[key] = a.expiring(value, 0)
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return actual, loaded, nil
+}
+
+func (a *anyStore) loadAndDelete(key any) (any, bool, error) {
+	var value any
+	loaded := false
+	err := a.mutate(func(kv anyMap) (bool, error) {
+		current, ok := kv.load(key, time.Now().UnixNano())
+		if !ok {
+			return false, nil
+		}
+		value = current
+		loaded = true
+		delete(kv, key)
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, loaded, nil
+}
+
+func (a *anyStore) swap(key, value any) (any, bool, error) {
+	var previous any
+	loaded := false
+	err := a.mutate(func(kv anyMap) (bool, error) {
+		previous, loaded = kv.load(key, time.Now().UnixNano())
+		kv[key] = a.expiring(value, 0)
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return previous, loaded, nil
+}
+
+// isComparable returns true if v can be compared using ==.
+func isComparable(v any) bool {
+	return v == nil || reflect.TypeOf(v).Comparable()
+}
+
+// equal compares x and y without panicking on values of non-comparable types
+// (which are never equal).
+func equal(x, y any) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	t := reflect.TypeOf(x)
+	if t != reflect.TypeOf(y) || !t.Comparable() {
+		return false
+	}
+	return x == y
+}
+
+func (a *anyStore) loadStoreAndSave(key any, value any, remove bool) error {
+	return a.loadModifyAndSave(func(kv anyMap) (bool, error) {
+		if remove {
+			delete(kv, key)
+		} else {
+			kv[key] = value
+		}
+		return true, nil
+	})
+}
+
+// replaceWith saves kv replacing the persistence file without loading it
+// first (e.g when the file can not be decrypted by the store).
+func (a *anyStore) replaceWith(kv anyMap) error {
+	backend, err := a.storage()
+	if err != nil {
+		return err
+	}
+	if err := backend.Lock(); err != nil {
+		return err
+	}
+	defer backend.Unlock()
+	if err := a.save(backend, kv); err != nil {
+		return err
+	}
+	a.setKV(kv)
+	return nil
+}
+
+func (a *anyStore) loadModifyAndSave(modify mutator) error {
+	backend, err := a.storage()
+	if err != nil {
+		return err
+	}
+	if err := backend.Lock(); err != nil {
+		return err
+	}
+	defer backend.Unlock()
+	// Make a new KV map from the persistence file
+	state, err := a.readState(backend)
+	if err != nil {
+		return err
+	}
+	kvN := state.kv.clone()
+	// Modify incoming KV pairs, e.g set our key/value on top or delete the key
+	changed, err := modify(kvN)
+	if err != nil {
+		return err
+	}
+	if changed {
+		// Expired entries are purged on every persisted write.
+		kvN.purge(time.Now().UnixNano())
+	}
+	if changed {
+		// Only a saved map is stored (and notified to watchers).
+		if err := a.persistChanges(backend, state, kvN); err != nil {
 			return err
 		}
 	}
-	kvN := make(anyMap)
-	if len(data) > 0 {
-		decrypted, err := Decrypt(encryptionKey, data)
+	// Store map
+	a.setKV(kvN)
+	return nil
+}
+
+// readPersistence reads, decrypts and decodes the persistence file. A missing
+// or empty file returns an empty map. If the file has not changed since it was
+// last decoded (or saved), the cached map is returned instead. The returned
+// map is shared and must not be modified.
+func (a *anyStore) readPersistence(backend Backend) (anyMap, error) {
+	state, err := a.readState(backend)
+	if err != nil {
+		return nil, err
+	}
+	return state.kv, nil
+}
+
+// readState returns the decoded state of the persistence file, either from
+// cache if the file has not changed, by replaying records appended to a cached
+// append-only log or by reading and decoding the entire file.
+func (a *anyStore) readState(backend Backend) (*persistenceCache, error) {
+	version, err := backend.Version()
+	if err != nil {
+		return nil, err
+	}
+	if c := a.cached(); c != nil && version != "" {
+		if c.version == version {
+			return c, nil
+		}
+		if ab, ok := backend.(AppendBackend); ok && c.log != nil {
+			if state, ok := a.replayAppended(ab, c); ok {
+				return state, nil
+			}
+		}
+	}
+	var state *persistenceCache
+	if sb, ok := backend.(StreamBackend); ok {
+		state, version, err = a.readStream(sb)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if len(decrypted) > 0 {
-			var in *gob.Decoder
-			if a.gzip.Load() {
-				gzipReader, err := gzip.NewReader(bytes.NewReader(decrypted))
-				if err != nil {
-					if errors.Is(err, gzip.ErrHeader) {
-						return fmt.Errorf("%w (perhaps persistence is not gzipped?)", err)
-					}
-					return err
-				}
-				in = gob.NewDecoder(gzipReader)
-			} else {
-				in = gob.NewDecoder(bytes.NewReader(decrypted))
+	} else {
+		var data []byte
+		data, version, err = backend.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if isLog(data) {
+			state, err = a.replayLog(data)
+			if err != nil {
+				return nil, err
 			}
-			if err := in.Decode(&kvN); err != nil {
-				if strings.Contains(err.Error(), "encoded unsigned integer out of range") && !a.gzip.Load() {
-					return fmt.Errorf("%w (perhaps persistence is gzipped?)", err)
-				}
-				return err
+		} else {
+			kv, err := a.decode(data)
+			if err != nil {
+				return nil, err
 			}
+			state = &persistenceCache{kv: kv}
 		}
 	}
-	a.kv.Store(kvN)
-	return nil
+	if version != "" {
+		state.version = version
+		a.setCache(state)
+	}
+	return state, nil
 }
 
-func (a *anyStore) loadStoreAndSave(key any, value any, remove bool) error {
-	encryptionKey := a.key.Load().([]byte)
-	file, ok := a.savefile.Load().(string)
-	if !ok {
-		return errors.New("persistence file not set")
+// readStream reads and decodes the entire content of backend as a stream.
+// An append-only log is read into memory and replayed.
+func (a *anyStore) readStream(backend StreamBackend) (*persistenceCache, Version, error) {
+	rc, version, err := backend.Open()
+	if err != nil {
+		return nil, "", err
 	}
-	lockfile := file + ".lock"
-	unlink := true
-	var lockfd int
-	for {
-		var err error
-		lockfd, err = syscall.Open(lockfile, syscall.O_CREAT|syscall.O_RDWR, 0666)
+	if rc == nil {
+		return &persistenceCache{kv: make(anyMap)}, version, nil
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	if prefix, _ := br.Peek(logHeaderSize); isLog(prefix) {
+		data, err := io.ReadAll(br)
 		if err != nil {
-			return err
+			return nil, "", err
+		}
+		state, err := a.replayLog(data)
+		return state, version, err
+	}
+	kv := make(anyMap)
+	if err := a.unmarshalFrom(br, &kv); err != nil {
+		return nil, "", err
+	}
+	return &persistenceCache{kv: kv}, version, nil
+}
+
+// persistChanges persists kvN (a modified copy of state.kv) either by
+// appending a record to the append-only log or by replacing the persistence
+// file. Caller must hold the lock of the backend.
+func (a *anyStore) persistChanges(backend Backend, state *persistenceCache, kvN anyMap) error {
+	if a.appendOnly.Load() {
+		return a.appendLog(backend, state, kvN)
+	}
+	return a.save(backend, kvN)
+}
+
+// decode decrypts, optionally gunzips and GOB-decodes data into a new anyMap.
+func (a *anyStore) decode(data []byte) (anyMap, error) {
+	kvN := make(anyMap)
+	if len(data) > 0 {
+		if err := a.unmarshal(data, &kvN); err != nil {
+			return nil, err
 		}
-		if err := syscall.Flock(lockfd, syscall.LOCK_EX); err != nil {
-			syscall.Close(lockfd)
+	}
+	return kvN, nil
+}
+
+// unmarshal decrypts, decompresses and decodes data into v (a pointer) using
+// the compression and codec recorded in the header. If the decrypted data is empty, v is
+// left untouched.
+func (a *anyStore) unmarshal(data []byte, v any) error {
+	return a.unmarshalFrom(bytes.NewReader(data), v)
+}
+
+// unmarshalFrom is unmarshal streaming from r (see NewDecryptReader), the
+// entire stream is read and authenticated. If r or the decrypted data is
+// empty, v is left untouched.
+func (a *anyStore) unmarshalFrom(r io.Reader, v any) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil
+	}
+	var decrypted io.Reader
+	var h header
+	if a.plaintext.Load() {
+		var err error
+		if decrypted, h, err = newPlainReader(br); err != nil {
 			return err
 		}
-		var stat_t syscall.Stat_t
-		if err := syscall.Fstat(lockfd, &stat_t); err != nil {
-			syscall.Close(lockfd)
+	} else {
+		keys, err := a.keys()
+		if err != nil {
 			return err
 		}
-		if stat_t.Nlink == 0 {
-			// File deleted (no hard links), recreate it
-			syscall.Close(lockfd)
-			continue
+		if decrypted, h, err = newDecryptReader(keys, br); err != nil {
+			return err
 		}
-		// We should have a lockfd with an existing file at this point
-		defer syscall.Close(lockfd)
-		break
 	}
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
+	codec, err := codecOf(h, a.codec)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
+	in := bufio.NewReader(decrypted)
+	if _, err := in.Peek(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	plain, err := newDecompressor(h, in)
 	if err != nil {
 		return err
 	}
-	// Make a new KV map
-	kvN := make(anyMap)
-	if len(data) > 0 {
-		decrypted, err := Decrypt(encryptionKey, data)
-		if err != nil {
-			return err
-		}
-		if len(decrypted) > 0 {
-			var in *gob.Decoder
-			if a.gzip.Load() {
-				gzipReader, err := gzip.NewReader(bytes.NewReader(decrypted))
-				if err != nil {
-					if errors.Is(err, gzip.ErrHeader) {
-						return fmt.Errorf("%w (perhaps persistence is not gzipped?)", err)
-					}
-					return err
-				}
-				in = gob.NewDecoder(gzipReader)
-			} else {
-				in = gob.NewDecoder(bytes.NewReader(decrypted))
-			}
-			if err := in.Decode(&kvN); err != nil {
-				if strings.Contains(err.Error(), "encoded unsigned integer out of range") && !a.gzip.Load() {
-					return fmt.Errorf("%w (perhaps persistence is gzipped?)", err)
-				}
-				return err
-			}
-		}
+	if err := decodeValue(codec, plain, v); err != nil {
+		return err
 	}
-	// Set our key/value on top of incoming KV pairs, or delete the key
-	if remove {
-		delete(kvN, key)
-	} else {
-		kvN[key] = value
+	// Authenticate (and check the checksum of the compressed) rest of the
+	// stream.
+	if _, err := io.Copy(io.Discard, plain); err != nil {
+		return err
 	}
-	// Store map
-	a.kv.Store(kvN)
-	// Store as GOB, encrypt it and save as temporary file along-side the original
-	// and replace the main file via rename (as rename is atomic, it will not
-	// corrupt the main file in the event of a crash).
+	return nil
+}
+
+// marshal encodes (using the codec of the store), optionally compresses and
+// encrypts v.
+func (a *anyStore) marshal(v any) ([]byte, error) {
 	var output bytes.Buffer
-	var out *gob.Encoder
-	var gzipWriter *gzip.Writer
-	if a.gzip.Load() {
-		gzipWriter = gzip.NewWriter(&output)
-		out = gob.NewEncoder(gzipWriter)
-	} else {
-		out = gob.NewEncoder(&output)
-	}
-	if err := out.Encode(kvN); err != nil {
-		if gzipWriter != nil {
-			gzipWriter.Close()
-		}
-		return err
+	if err := a.marshalTo(&output, v); err != nil {
+		return nil, err
 	}
-	if gzipWriter != nil {
-		gzipWriter.Close()
+	return output.Bytes(), nil
+}
+
+// marshalTo is marshal streaming to w (see NewEncryptWriter).
+func (a *anyStore) marshalTo(w io.Writer, v any) error {
+	fields := append(codecHeader(a.getCodec()), compressionHeader(a.compression)...)
+	if a.plaintext.Load() {
+		return writePlain(w, fields, func(w io.Writer) error {
+			return a.encodeTo(w, v)
+		})
 	}
-	encryptedOutput, err := Encrypt(encryptionKey, output.Bytes())
+	keys, err := a.keys()
 	if err != nil {
 		return err
 	}
-	newFilename := file + "." + rndstr(10)
-	tmpf, err := os.OpenFile(newFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	encrypted, err := newEncryptWriter(keys, w, fields)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if unlink {
-			os.Remove(newFilename)
-		}
-	}()
-	if n, err := tmpf.Write(encryptedOutput); err != nil {
-		tmpf.Close()
+	if err := a.encodeTo(encrypted, v); err != nil {
 		return err
-	} else if n != len(encryptedOutput) {
-		tmpf.Close()
-		return ErrWroteTooLittle
 	}
-	tmpf.Sync()
-	tmpf.Close()
-	if err := os.Rename(newFilename, file); err != nil {
+	return encrypted.Close()
+}
+
+// encodeTo encodes (using the codec of the store) and optionally compresses v
+// into w.
+func (a *anyStore) encodeTo(w io.Writer, v any) error {
+	plain, err := newCompressor(a.compression, a.compressionLevel, w)
+	if err != nil {
 		return err
 	}
-	unlink = false
+	if err := encodeValue(a.getCodec(), plain, v); err != nil {
+		return err
+	}
+	return plain.Close()
+}
+
+// save stores kv as GOB, encrypts it and replaces the content of the backend
+// with it, streaming if the backend is a StreamBackend. Caller must hold the
+// lock of the backend.
+func (a *anyStore) save(backend Backend, kv anyMap) error {
+	var version Version
+	if sb, ok := backend.(StreamBackend); ok {
+		var err error
+		version, err = sb.ReplaceWith(func(w io.Writer) error {
+			return a.marshalTo(w, kv)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		encryptedOutput, err := a.marshal(kv)
+		if err != nil {
+			return err
+		}
+		version, err = backend.Replace(encryptedOutput)
+		if err != nil {
+			return err
+		}
+	}
+	// The saved map can be cached as is.
+	a.setCache(&persistenceCache{version: version, kv: kv})
 	return nil
 }
 
@@ -676,34 +1210,11 @@ func (a *anyStore) loadStoreAndSave(key any, value any, remove bool) error {
 // function. All functions need to defined to implement the AnyStore interface.
 
 func (u *unsafeAnyStore) SetPersistenceFile(file string) (AnyStore, error) {
-	// If persistence file starts with a tilde, resolve it to the user's home
-	// directory.
-	if strings.HasPrefix(file, "~/") {
-		dirname, err := os.UserHomeDir()
-		if err != nil {
-			return u, err
-		}
-		file = filepath.Join(dirname, file[2:])
-	}
-	dir, _ := filepath.Split(file)
-	if _, err := os.Stat(file); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			if err := os.MkdirAll(dir, 0777); err != nil {
-				return u, err
-			}
-		} else {
-			return u, err
-		}
-	}
-	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	backend, err := NewFileBackend(file)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return u, err
-		}
-	} else {
-		f.Close()
+		return u, err
 	}
-	u.savefile.Store(file)
+	u.setStorage(backend)
 	return u, nil
 }
 
@@ -718,21 +1229,16 @@ func (u *unsafeAnyStore) DisablePersistence() AnyStore {
 }
 
 func (u *unsafeAnyStore) SetEncryptionKey(key string) (AnyStore, error) {
-	binkey, err := base64.RawStdEncoding.DecodeString(key)
+	binkey, err := u.decodeExplicitKey(key)
 	if err != nil {
 		return u, err
 	}
-	switch len(binkey) {
-	case 16, 24, 32:
-	default:
-		return u, ErrKeyLength
-	}
-	u.key.Store(binkey)
+	u.setKeys(binkey)
 	return u, nil
 }
 
 func (u *unsafeAnyStore) GetEncryptionKeyBytes() []byte {
-	return u.key.Load().([]byte)
+	return u.anyStore.GetEncryptionKeyBytes()
 }
 
 func (u *unsafeAnyStore) HasKey(key any) bool {
@@ -740,7 +1246,7 @@ func (u *unsafeAnyStore) HasKey(key any) bool {
 		u.load()
 	}
 	kv := u.kv.Load().(anyMap)
-	_, ok := kv[key]
+	_, ok := kv.load(key, time.Now().UnixNano())
 	return ok
 }
 
@@ -752,20 +1258,21 @@ func (u *unsafeAnyStore) Load(key any) (any, error) {
 		}
 	}
 	kv := u.kv.Load().(anyMap)
-	return kv[key], nil
+	value, _ := kv.load(key, time.Now().UnixNano())
+	return value, nil
 }
 
 func (u *unsafeAnyStore) Store(key any, value any) error {
 	if u.persist.Load() {
-		return u.loadStoreAndSave(key, value, false)
+		return u.loadStoreAndSave(key, u.expiring(value, 0), false)
 	}
 	kvO := u.kv.Load().(anyMap)
 	kvN := make(anyMap)
 	for k, v := range kvO {
 		kvN[k] = v
 	}
-	kvN[key] = value
-	u.kv.Store(kvN)
+	kvN[key] = u.expiring(value, 0)
+	u.setKV(kvN)
 	return nil
 }
 
@@ -779,17 +1286,37 @@ func (u *unsafeAnyStore) Delete(key any) error {
 		kvN[k] = v
 	}
 	delete(kvN, key)
-	u.kv.Store(kvN)
+	u.setKV(kvN)
 	return nil
 }
 
+func (u *unsafeAnyStore) CompareAndSwap(key, old, new any) (bool, error) {
+	return u.compareAndSwap(key, old, new)
+}
+
+func (u *unsafeAnyStore) CompareAndDelete(key, old any) (bool, error) {
+	return u.compareAndDelete(key, old)
+}
+
+func (u *unsafeAnyStore) LoadOrStore(key, value any) (any, bool, error) {
+	return u.loadOrStore(key, value)
+}
+
+func (u *unsafeAnyStore) LoadAndDelete(key any) (any, bool, error) {
+	return u.loadAndDelete(key)
+}
+
+func (u *unsafeAnyStore) Swap(key, value any) (any, bool, error) {
+	return u.swap(key, value)
+}
+
 func (u *unsafeAnyStore) Len() (int, error) {
 	if u.persist.Load() {
 		if err := u.load(); err != nil {
 			return 0, err
 		}
 	}
-	return len(u.kv.Load().(anyMap)), nil
+	return u.kv.Load().(anyMap).len(time.Now().UnixNano()), nil
 }
 
 func (u *unsafeAnyStore) Keys() ([]any, error) {
@@ -801,228 +1328,42 @@ func (u *unsafeAnyStore) Keys() ([]any, error) {
 	keys := make([]any, 0)
 	kv, ok := u.kv.Load().(anyMap)
 	if ok {
-		for k, _ := range kv {
-			keys = append(keys, k)
-		}
+		keys = kv.keys(time.Now().UnixNano())
 	}
 	return keys, nil
 }
 
-func (u *unsafeAnyStore) Run(atomicOperation func(s AnyStore) error) error {
-	return atomicOperation(u)
+func (u *unsafeAnyStore) Range(f func(key, value any) bool) error {
+	snapshot, err := u.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.Range(f)
+	return nil
 }
 
-func (u *unsafeAnyStore) Close() error {
+func (u *unsafeAnyStore) Snapshot() (*Snapshot, error) {
 	if u.persist.Load() {
-		file, ok := u.savefile.Load().(string)
-		if !ok {
-			return errors.New("persistence not set")
-		}
-		lockfile := file + ".lock"
-		_, err := os.Stat(lockfile)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return nil
-			}
-			return err
-		}
-		if err := os.Remove(lockfile); err != nil {
-			return err
+		if err := u.load(); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return &Snapshot{kv: u.kv.Load().(anyMap), now: time.Now().UnixNano()}, nil
 }
 
-func (u *unsafeAnyStore) load() error {
-	file, ok := u.savefile.Load().(string)
-	if !ok {
-		return errors.New("no persistence file set")
-	}
-	encryptionKey, ok := u.key.Load().([]byte)
-	if !ok {
-		return errors.New("encryption key not set")
-	}
-	// lockfile := file + ".lock"
-	// lockfd, err := syscall.Open(lockfile, syscall.O_CREAT|syscall.O_RDWR, 0666)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer syscall.Close(lockfd)
-	// if err := syscall.Flock(lockfd, syscall.LOCK_EX); err != nil {
-	// 	return err
-	// }
-	data := []byte{}
-	f, err := os.OpenFile(file, os.O_RDONLY, 0666)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return err
-		}
-	} else {
-		data, err = io.ReadAll(f)
-		f.Close()
-		if err != nil {
-			return err
-		}
-	}
-	kvN := make(anyMap)
-	if len(data) > 0 {
-		decrypted, err := Decrypt(encryptionKey, data)
-		if err != nil {
-			return err
-		}
-		if len(decrypted) > 0 {
-			var in *gob.Decoder
-			if u.gzip.Load() {
-				gzipReader, err := gzip.NewReader(bytes.NewReader(decrypted))
-				if err != nil {
-					if errors.Is(err, gzip.ErrHeader) {
-						return fmt.Errorf("%w (perhaps persistence is not gzipped?)", err)
-					}
-					return err
-				}
-				in = gob.NewDecoder(gzipReader)
-			} else {
-				in = gob.NewDecoder(bytes.NewReader(decrypted))
-			}
-			if err := in.Decode(&kvN); err != nil {
-				if strings.Contains(err.Error(), "encoded unsigned integer out of range") && !u.gzip.Load() {
-					return fmt.Errorf("%w (perhaps persistence is gzipped?)", err)
-				}
-				return err
-			}
-		}
-	}
-	u.kv.Store(kvN)
-	return nil
+func (u *unsafeAnyStore) Run(atomicOperation func(s AnyStore) error) error {
+	return atomicOperation(u)
 }
 
-func (u *unsafeAnyStore) loadStoreAndSave(key any, value any, remove bool) error {
-	encryptionKey := u.key.Load().([]byte)
-	file, ok := u.savefile.Load().(string)
-	if !ok {
-		return errors.New("persistence file not set")
-	}
-	lockfile := file + ".lock"
-	unlink := true
-	var lockfd int
-	for {
-		var err error
-		lockfd, err = syscall.Open(lockfile, syscall.O_CREAT|syscall.O_RDWR, 0666)
-		if err != nil {
-			return err
-		}
-		if err := syscall.Flock(lockfd, syscall.LOCK_EX); err != nil {
-			syscall.Close(lockfd)
-			return err
-		}
-		var stat_t syscall.Stat_t
-		if err := syscall.Fstat(lockfd, &stat_t); err != nil {
-			syscall.Close(lockfd)
-			return err
-		}
-		if stat_t.Nlink == 0 {
-			// File deleted (no hard links), recreate it
-			syscall.Close(lockfd)
-			continue
-		}
-		// We should have a lockfd with an existing file at this point
-		defer syscall.Close(lockfd)
-		break
-	}
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return err
-	}
-	// Make a new KV map
-	kvN := make(anyMap)
-	if len(data) > 0 {
-		decrypted, err := Decrypt(encryptionKey, data)
+func (u *unsafeAnyStore) Close() error {
+	u.watch.close()
+	if u.persist.Load() {
+		backend, err := u.storage()
 		if err != nil {
 			return err
 		}
-		if len(decrypted) > 0 {
-			var in *gob.Decoder
-			if u.gzip.Load() {
-				gzipReader, err := gzip.NewReader(bytes.NewReader(decrypted))
-				if err != nil {
-					if errors.Is(err, gzip.ErrHeader) {
-						return fmt.Errorf("%w (perhaps persistence is not gzipped?)", err)
-					}
-					return err
-				}
-				in = gob.NewDecoder(gzipReader)
-			} else {
-				in = gob.NewDecoder(bytes.NewReader(decrypted))
-			}
-			if err := in.Decode(&kvN); err != nil {
-				if strings.Contains(err.Error(), "encoded unsigned integer out of range") && !u.gzip.Load() {
-					return fmt.Errorf("%w (perhaps persistence is gzipped?)", err)
-				}
-				return err
-			}
-		}
+		return backend.Close()
 	}
-	// Set our key/value on top of incoming KV pairs, or delete the key
-	if remove {
-		delete(kvN, key)
-	} else {
-		kvN[key] = value
-	}
-	// Store map
-	u.kv.Store(kvN)
-	// Store as GOB, encrypt it and save as temporary file along-side the original
-	// and replace the main file via rename (as rename is atomic, it will not
-	// corrupt the main file in the event of a crash).
-	var output bytes.Buffer
-	var out *gob.Encoder
-	var gzipWriter *gzip.Writer
-	if u.gzip.Load() {
-		gzipWriter = gzip.NewWriter(&output)
-		out = gob.NewEncoder(gzipWriter)
-	} else {
-		out = gob.NewEncoder(&output)
-	}
-	if err := out.Encode(kvN); err != nil {
-		if gzipWriter != nil {
-			gzipWriter.Close()
-		}
-		return err
-	}
-	if gzipWriter != nil {
-		gzipWriter.Close()
-	}
-	encryptedOutput, err := Encrypt(encryptionKey, output.Bytes())
-	if err != nil {
-		return err
-	}
-	newFilename := file + "." + rndstr(10)
-	tmpf, err := os.OpenFile(newFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if unlink {
-			os.Remove(newFilename)
-		}
-	}()
-	if n, err := tmpf.Write(encryptedOutput); err != nil {
-		tmpf.Close()
-		return err
-	} else if n != len(encryptedOutput) {
-		tmpf.Close()
-		return ErrWroteTooLittle
-	}
-	tmpf.Sync()
-	tmpf.Close()
-	if err := os.Rename(newFilename, file); err != nil {
-		return err
-	}
-	unlink = false
 	return nil
 }
 
@@ -1056,53 +1397,199 @@ func NewKey() string {
 	return base64.RawStdEncoding.EncodeToString(randomBytes)
 }
 
-// Encrypt encrypts data using a 16, 24 or 32 byte long key (for
-// AES-128-CFB, AES-224-CFB or AES-256-CFB). The cipher-data is
-// prepended with a HMAC-SHA256 hash (32 bytes) and IV (or salt if you
-// prefer). Same key is used for HMAC and. The format of the output
-// data slice is:
+// Encrypt encrypts and authenticates data using a 16, 24 or 32 byte long
+// master key. Independent AES-256-GCM encryption and HMAC-SHA256
+// authentication subkeys are derived from the master key and a random salt
+// using HKDF-SHA256. The output starts with a header (magic, version and
+// fields such as the KDF, salt and random nonce) which is authenticated as
+// AES-GCM associated data, followed by the ciphertext, the AES-GCM tag and a
+// HMAC-SHA256 of everything before it:
 //
 //	b = bytes
-//	[HMAC_of_IV_and_cipherdata_32_b][IV_16_b][cipherdata]
+//	["ANYE"][version_1_b][header_length_2_b][header_fields][cipherdata][tag_16_b][HMAC_32_b]
 func Encrypt(key []byte, data []byte) ([]byte, error) {
-	// Maybe implement later, but comes from an external package...
-	//dk := pbkdf2.Key(key, []byte(salt), 4096, 32, sha256.New)
-
 	switch len(key) {
 	case 16, 24, 32:
 	default:
 		return nil, ErrKeyLength
 	}
-	block, err := aes.NewCipher(key)
+	return encrypt(rawKey(key), data)
+}
+
+// encrypt implements Encrypt using the master key from keys.
+func encrypt(keys keySource, data []byte) ([]byte, error) {
+	key, fields, err := keys.sealKey()
 	if err != nil {
 		return nil, err
 	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	encryptionKey, authenticationKey := deriveKeys(key, salt)
+	defer wipe(encryptionKey)
+	defer wipe(authenticationKey)
+	gcm, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	h := header{{tag: tagCipher, value: []byte{cipherAESGCM}}}
+	h = append(h, fields...)
+	h = append(h,
+		headerField{tag: tagKDF, value: []byte{kdfHKDFSHA256}},
+		headerField{tag: tagSalt, value: salt},
+		headerField{tag: tagNonce, value: nonce},
+	)
+	aad := h.marshal()
+	mac := hmac.New(sha256.New, authenticationKey)
+	ciphered := make([]byte, len(aad), len(aad)+len(data)+gcm.Overhead()+mac.Size())
+	copy(ciphered, aad)
+	ciphered = gcm.Seal(ciphered, nonce, data, aad)
+	mac.Write(ciphered)
+	return mac.Sum(ciphered), nil
+}
 
-	mac := hmac.New(sha256.New, key)
+// Decrypt authenticates and decrypts data using a 16, 24 or 32 byte long key.
+// The format is detected from the data: data produced by Encrypt (see above)
+// is decrypted using AES-GCM (with the key as is if the header does not
+// specify a KDF) and returns ErrAuthenticationFailed when the key is wrong or
+// the data is corrupt or tampered with. Data in the legacy format should start
+// with a HMAC-SHA256 hash (32 bytes) initialized with key. The hash function
+// should hash the rest of data which includes an aes.BlockSize long IV and the
+// AES-CFB encrypted data. Legacy data returns anystore.ErrHMACValidationFailed
+// when the key is wrong or the message is corrupt or tampered with. Returns
+// clear-data or error in case of failure.
+func Decrypt(key []byte, data []byte) ([]byte, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrKeyLength
+	}
+	return decrypt(rawKey(key), data)
+}
+
+// decrypt implements Decrypt using the master key from keys. Legacy data is
+// decrypted using the candidate master keys of keys for data without a header.
+func decrypt(keys keySource, data []byte) ([]byte, error) {
+	if isFormatted(data) {
+		deciphered, err := decryptGCM(keys, data)
+		if err == nil {
+			return deciphered, nil
+		}
+		// The HMAC of legacy data could start with the magic by chance.
+		if deciphered, legacyErr := decryptLegacyKeys(keys, data); legacyErr == nil {
+			return deciphered, nil
+		}
+		return nil, err
+	}
+	return decryptLegacyKeys(keys, data)
+}
+
+// decryptLegacyKeys decrypts legacy data trying each candidate master key of
+// keys, or the current master key if keys can not open data without a header.
+func decryptLegacyKeys(keys keySource, data []byte) ([]byte, error) {
+	candidates, err := keys.openKeys(nil)
+	if err != nil {
+		candidates = [][]byte{keys.bytes()}
+	}
+	err = ErrHMACValidationFailed
+	for _, key := range candidates {
+		var deciphered []byte
+		if deciphered, err = decryptLegacy(key, data); err == nil {
+			return deciphered, nil
+		}
+	}
+	return nil, err
+}
+
+// decryptGCM decrypts data produced by Encrypt, trying each candidate master
+// key of keys.
+func decryptGCM(keys keySource, data []byte) ([]byte, error) {
+	h, aad, sealed, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(h); err != nil {
+		return nil, err
+	}
+	if _, ok := h.get(tagChunkSize); ok {
+		return decryptStream(keys, data)
+	}
+	candidates, err := keys.openKeys(h)
+	if err != nil {
+		return nil, err
+	}
+	err = ErrAuthenticationFailed
+	for _, key := range candidates {
+		var deciphered []byte
+		if deciphered, err = openGCM(key, h, aad, sealed, data); err == nil {
+			return deciphered, nil
+		}
+	}
+	return nil, err
+}
 
-	ciphered := make([]byte, mac.Size()+aes.BlockSize+len(data))
-	iv := ciphered[mac.Size() : aes.BlockSize+mac.Size()]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+// openGCM authenticates and decrypts the sealed part of data with header h
+// (raw header aad) using master key key.
+func openGCM(key []byte, h header, aad, sealed, data []byte) ([]byte, error) {
+	encryptionKey := key
+	if kdf, ok := h.get(tagKDF); ok {
+		if len(kdf) != 1 || kdf[0] != kdfHKDFSHA256 {
+			return nil, fmt.Errorf("%w: unknown KDF", ErrUnsupportedFormat)
+		}
+		salt, ok := h.get(tagSalt)
+		if !ok {
+			return nil, fmt.Errorf("%w: missing salt", ErrUnsupportedFormat)
+		}
+		var authenticationKey []byte
+		encryptionKey, authenticationKey = deriveKeys(key, salt)
+		defer wipe(encryptionKey)
+		mac := hmac.New(sha256.New, authenticationKey)
+		wipe(authenticationKey)
+		if len(sealed) < mac.Size() {
+			return nil, ErrAuthenticationFailed
+		}
+		messageMAC := data[len(data)-mac.Size():]
+		mac.Write(data[:len(data)-mac.Size()])
+		if !hmac.Equal(messageMAC, mac.Sum(nil)) {
+			return nil, ErrAuthenticationFailed
+		}
+		sealed = sealed[:len(sealed)-mac.Size()]
+	}
+	gcm, err := newGCM(encryptionKey)
+	if err != nil {
 		return nil, err
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphered[mac.Size()+aes.BlockSize:], data)
+	nonce, ok := h.get(tagNonce)
+	if !ok || len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrUnsupportedFormat)
+	}
+	deciphered, err := gcm.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return deciphered, nil
+}
 
-	if _, err := mac.Write(ciphered[mac.Size():]); err != nil {
+// newGCM returns an AES-GCM AEAD using key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
 		return nil, err
 	}
-	copy(ciphered[:mac.Size()], mac.Sum(nil))
-	return ciphered, nil
+	return cipher.NewGCM(block)
 }
 
-// Decrypt authenticates and decrypts data using a 16, 24 or 32 byte
-// long key (for AES-128-CFB, AES-224-CFB or AES-256-CFB). The data should start
-// with a HMAC-SHA256 hash (32 bytes) initialized with key. The hash function
-// should hash the rest of data which includes an aes.BlockSize long IV
-// and the AES-CFB encrypted data. Returns clear-data or error in case
-// of failure. Returns anystore.ErrHMACValidationFailed when the key
-// is wrong or the message is corrupt or tampered with.
-func Decrypt(key []byte, data []byte) ([]byte, error) {
+// decryptLegacy decrypts data in the legacy AES-CFB with HMAC-SHA256 format
+// (same key for both):
+//
+//	b = bytes
+//	[HMAC_of_IV_and_cipherdata_32_b][IV_16_b][cipherdata]
+func decryptLegacy(key []byte, data []byte) ([]byte, error) {
 	switch len(key) {
 	case 16, 24, 32:
 	default:
@@ -3,9 +3,12 @@ package anystore_test
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
@@ -695,34 +698,18 @@ func FuzzConcurrentPersistence(f *testing.F) {
 func TestEncrypt(t *testing.T) {
 	encTestFunc := func(key []byte, data []byte) {
 		t.Logf("Testing %d bytes long key", len(key))
-		mac := hmac.New(sha256.New, key)
-		block, err := aes.NewCipher(key)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if aes.BlockSize != block.BlockSize() {
-			t.Errorf("aes.BlockSize != block.BlockSize(), but %d and %d respectively", aes.BlockSize, block.BlockSize())
-		}
-		t.Logf("mac.Size() = %d", mac.Size())
-		t.Logf("aes.BlockSize = %d", aes.BlockSize)
-		t.Logf("block.BlockSize = %d", block.BlockSize())
 		encrypted, err := anystore.Encrypt(key, data)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if len(encrypted) < mac.Size()+aes.BlockSize {
-			t.Fatalf("length of enciphered data is less than mac.Size()+aes.BlockSize (want>%d, got %d)", mac.Size()+aes.BlockSize, len(encrypted))
-		}
-		// Get HMAC from cipher-text
-		encryptedHMAC := encrypted[:mac.Size()]
-		message := encrypted[mac.Size():]
-		//iv := encrypted[mac.Size() : mac.Size()+aes.BlockSize]
-		//cipherText := encrypted[mac.Size()+aes.BlockSize:]
-		if _, err := mac.Write(message); err != nil {
-			t.Fatal(err)
+		// magic, version, header length, cipher, KDF, salt and nonce fields,
+		// AES-GCM tag and HMAC-SHA256
+		overhead := 4 + 1 + 2 + (3 + 1) + (3 + 1) + (3 + 32) + (3 + 12) + 16 + 32
+		if len(encrypted) != overhead+len(data) {
+			t.Fatalf("expected %d bytes of enciphered data, got %d", overhead+len(data), len(encrypted))
 		}
-		if !hmac.Equal(encryptedHMAC, mac.Sum(nil)) {
-			t.Fatal(anystore.ErrHMACValidationFailed)
+		if !bytes.Equal(encrypted[:5], []byte("ANYE\x01")) {
+			t.Fatalf("expected magic and version 1, got %v", encrypted[:5])
 		}
 		// Decrypt must also work
 		decrypted, err := anystore.Decrypt(key, encrypted)
@@ -734,6 +721,14 @@ func TestEncrypt(t *testing.T) {
 			t.Logf("decrypted=%v", decrypted)
 			t.Fatal("original data and decrypted data (from encryption) does not match")
 		}
+		// The header is authenticated as well as the cipher-data.
+		for _, i := range []int{6, 10, len(encrypted) - 1} {
+			tampered := bytes.Clone(encrypted)
+			tampered[i] ^= 0x01
+			if _, err := anystore.Decrypt(key, tampered); err == nil {
+				t.Errorf("expected error decrypting data tampered with at offset %d", i)
+			}
+		}
 	}
 
 	key, err := anystore.ToBinaryEncryptionKey(anystore.NewKey())
@@ -750,27 +745,40 @@ func TestEncrypt(t *testing.T) {
 	for _, k := range keys {
 		encTestFunc(k, data)
 	}
+	wrongKey, err := anystore.ToBinaryEncryptionKey(anystore.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := anystore.Encrypt(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anystore.Decrypt(wrongKey, encrypted); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
 }
 
-func TestDecrypt(t *testing.T) {
-	decrypTestFunc := func(key []byte, data []byte) {
-		t.Logf("Testing %d bytes long key", len(key))
-		mac := hmac.New(sha256.New, key)
-		if len(data) < mac.Size()+aes.BlockSize {
-			t.Fatalf("length of cipher data is less than mac.Size()+aes.BlockSize (want>%d, got %d)", mac.Size()+aes.BlockSize, len(data))
-		}
-		messageWithIV := data[mac.Size():]
-		t.Logf("mac.Size() == %d", mac.Size())
-		t.Logf("data is %d bytes long, w/o HMAC == %d", len(data), len(messageWithIV))
-		messageHMAC := data[:mac.Size()]
-		if _, err := mac.Write(messageWithIV); err != nil {
-			t.Fatal(err)
-		}
-		if !hmac.Equal(messageHMAC, mac.Sum(nil)) {
-			t.Fatal(anystore.ErrHMACValidationFailed)
-		}
+// legacyEncrypt produces the legacy AES-CFB with HMAC-SHA256 format:
+// [HMAC_of_IV_and_cipherdata_32_b][IV_16_b][cipherdata]
+func legacyEncrypt(t *testing.T, key []byte, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, key)
+	ciphered := make([]byte, mac.Size()+aes.BlockSize+len(data))
+	iv := ciphered[mac.Size() : mac.Size()+aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
 	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphered[mac.Size()+aes.BlockSize:], data)
+	mac.Write(ciphered[mac.Size():])
+	copy(ciphered[:mac.Size()], mac.Sum(nil))
+	return ciphered
+}
 
+func TestDecrypt(t *testing.T) {
 	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
 	key, err := anystore.ToBinaryEncryptionKey(anystore.NewKey())
 	if err != nil {
@@ -778,11 +786,263 @@ func TestDecrypt(t *testing.T) {
 	}
 
 	for _, k := range [][]byte{key, key[:24], key[:16]} {
-		ciphered, err := anystore.Encrypt(k, data)
+		t.Logf("Testing %d bytes long key", len(k))
+		legacy := legacyEncrypt(t, k, data)
+		decrypted, err := anystore.Decrypt(k, legacy)
 		if err != nil {
 			t.Fatal(err)
 		}
-		decrypTestFunc(k, ciphered)
+		if !bytes.Equal(data, decrypted) {
+			t.Fatal("original data and decrypted legacy data does not match")
+		}
+		legacy[len(legacy)-1] ^= 0x01
+		if _, err := anystore.Decrypt(k, legacy); !errors.Is(err, anystore.ErrHMACValidationFailed) {
+			t.Errorf("expected ErrHMACValidationFailed, got %v", err)
+		}
+	}
+}
+
+// rawKeyEncrypt produces version 1 of the format without a KDF, where key is
+// used as is for AES-GCM.
+func rawKeyEncrypt(t *testing.T, key []byte, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	aad := []byte("ANYE\x01\x00\x13")
+	aad = append(aad, 1, 0, 1, 1)
+	aad = append(aad, 2, 0, byte(len(nonce)))
+	aad = append(aad, nonce...)
+	return gcm.Seal(bytes.Clone(aad), nonce, data, aad)
+}
+
+func TestDecrypt_rawKey(t *testing.T) {
+	data := []byte("encrypted without a KDF")
+	key, err := anystore.ToBinaryEncryptionKey(anystore.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := anystore.Decrypt(key, rawKeyEncrypt(t, key, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, decrypted) {
+		t.Fatal("original data and decrypted data does not match")
+	}
+	// Data encrypted with the same key, but with derived subkeys, must not be
+	// decryptable using the key as is and vice versa.
+	encrypted, err := anystore.Encrypt(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedOnly := encrypted[:len(encrypted)-sha256.Size]
+	if _, err := anystore.Decrypt(key, sealedOnly); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
+}
+
+func TestAnyStore_legacyPersistenceFile(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-legacy-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	secret := anystore.NewKey()
+	key, err := anystore.ToBinaryEncryptionKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gobbed bytes.Buffer
+	if err := gob.NewEncoder(&gobbed).Encode(map[any]any{"hello": "world"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(legacyEncrypt(t, key, gobbed.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	// New writes use the new format.
+	if err := a.Store("hello", "again"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(tempfile)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if !bytes.HasPrefix(data, []byte("ANYE")) {
+		t.Error("expected persistence file to be saved in the new format")
+	}
+}
 
+func TestAnyStore_CompareAndSwap(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := a.CompareAndSwap("counter", 0, 1); err != nil {
+		t.Fatal(err)
+	} else if swapped {
+		t.Error("expected CompareAndSwap on missing key to return false")
+	}
+	if actual, loaded, err := a.LoadOrStore("counter", 1); err != nil {
+		t.Fatal(err)
+	} else if loaded || actual != 1 {
+		t.Errorf("expected LoadOrStore to store 1, got %v (loaded=%t)", actual, loaded)
+	}
+	if actual, loaded, err := a.LoadOrStore("counter", 2); err != nil {
+		t.Fatal(err)
+	} else if !loaded || actual != 1 {
+		t.Errorf("expected LoadOrStore to load 1, got %v (loaded=%t)", actual, loaded)
+	}
+	if swapped, err := a.CompareAndSwap("counter", 2, 3); err != nil {
+		t.Fatal(err)
+	} else if swapped {
+		t.Error("expected CompareAndSwap with wrong old value to return false")
+	}
+	if swapped, err := a.CompareAndSwap("counter", 1, 2); err != nil {
+		t.Fatal(err)
+	} else if !swapped {
+		t.Error("expected CompareAndSwap to swap 1 for 2")
+	}
+	if _, err := a.CompareAndSwap("counter", []byte{1}, 3); !errors.Is(err, anystore.ErrNotComparable) {
+		t.Errorf("expected ErrNotComparable, got %v", err)
+	}
+	if err := a.Store("slice", []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := a.CompareAndDelete("slice", "x"); err != nil {
+		t.Fatal(err)
+	} else if deleted {
+		t.Error("expected CompareAndDelete on non-comparable value to return false")
+	}
+	if previous, loaded, err := a.Swap("counter", 10); err != nil {
+		t.Fatal(err)
+	} else if !loaded || previous != 2 {
+		t.Errorf("expected Swap to return previous value 2, got %v (loaded=%t)", previous, loaded)
+	}
+	if deleted, err := a.CompareAndDelete("counter", 10); err != nil {
+		t.Fatal(err)
+	} else if !deleted {
+		t.Error("expected CompareAndDelete to delete counter")
+	}
+	if value, loaded, err := a.LoadAndDelete("slice"); err != nil {
+		t.Fatal(err)
+	} else if !loaded || !bytes.Equal(value.([]byte), []byte{1}) {
+		t.Errorf("expected LoadAndDelete to return []byte{1}, got %v (loaded=%t)", value, loaded)
+	}
+	if l, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 0 {
+		t.Errorf("expected Len() == 0, got %d", l)
+	}
+}
+
+func TestAnyStore_CompareAndSwap_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-cas-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	const workers = 4
+	const increments = 10
+	errch := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			// Separate instances only share the persistence file, emulating
+			// separate processes.
+			a, err := anystore.NewAnyStore(&anystore.Options{
+				EnablePersistence: true,
+				PersistenceFile:   tempfile,
+			})
+			if err != nil {
+				errch <- err
+				return
+			}
+			if _, _, err := a.LoadOrStore("counter", 0); err != nil {
+				errch <- err
+				return
+			}
+			for i := 0; i < increments; {
+				v, err := a.Load("counter")
+				if err != nil {
+					errch <- err
+					return
+				}
+				swapped, err := a.CompareAndSwap("counter", v, v.(int)+1)
+				if err != nil {
+					errch <- err
+					return
+				}
+				if swapped {
+					i++
+				}
+			}
+			errch <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != workers*increments {
+		t.Errorf("expected counter == %d, got %v", workers*increments, v)
+	}
+	err = a.Run(func(s anystore.AnyStore) error {
+		previous, loaded, err := s.LoadAndDelete("counter")
+		if err != nil {
+			return err
+		}
+		if !loaded || previous != workers*increments {
+			t.Errorf("expected LoadAndDelete to return %d, got %v", workers*increments, previous)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.HasKey("counter") {
+		t.Error("expected counter to be deleted")
+	}
 }
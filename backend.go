@@ -0,0 +1,482 @@
+package anystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Version identifies the content of a Backend. Versions are only compared for
+// equality, a Backend must return a new Version whenever its content changes.
+// The zero Version (empty string) means there is no content (e.g the
+// persistence file does not exist).
+type Version string
+
+// Backend is the storage of a persisted AnyStore holding the encrypted (and
+// optionally compressed) GOB-encoded map. All writes (Replace) are made while
+// holding the lock from Lock, reads (ReadAll and Version) are made without it
+// and must therefore never observe a partially replaced content. The default
+// Backend is the persistence file (see NewFileBackend), set Options.Backend to
+// use another.
+type Backend interface {
+	// Lock blocks until an exclusive lock shared by all processes and
+	// instances using the same storage is acquired.
+	Lock() error
+	// Unlock releases the lock acquired by Lock.
+	Unlock() error
+	// Version returns the current Version of the content.
+	Version() (Version, error)
+	// ReadAll returns the entire content and its Version. No content returns
+	// nil data and the zero Version. The returned data must not be modified.
+	ReadAll() ([]byte, Version, error)
+	// Replace atomically replaces the entire content with data and returns the
+	// new Version. Caller must hold the lock from Lock. Backends unable to
+	// replace atomically must document it (see NewReadWriteSeekerBackend).
+	Replace(data []byte) (Version, error)
+	// Close releases any resources held by the Backend.
+	Close() error
+}
+
+// AppendBackend is a Backend able to append to its content in place. In
+// append-only mode (Options.AppendOnly), changes are appended using Append
+// and only content appended since the last load is read using ReadFrom. A
+// Backend not implementing AppendBackend has the log compacted (replaced) on
+// every change.
+type AppendBackend interface {
+	Backend
+	// ReadFrom returns the content from offset to the end and the current
+	// Version. An offset at or beyond the end returns no data.
+	ReadFrom(offset int64) ([]byte, Version, error)
+	// Append truncates the content to offset (dropping anything beyond it)
+	// and writes data at offset. Returns the new Version. Caller must hold the
+	// lock from Lock.
+	Append(offset int64, data []byte) (Version, error)
+}
+
+// StreamBackend is a Backend able to read and replace its content as a
+// stream, avoiding holding the entire (encrypted) content in memory. A Backend
+// not implementing StreamBackend is read using ReadAll and replaced using
+// Replace.
+type StreamBackend interface {
+	Backend
+	// Open returns a reader of the entire content and its Version. No content
+	// returns a nil reader and the zero Version. The reader must keep reading
+	// the content of the returned Version even if it is replaced.
+	Open() (io.ReadCloser, Version, error)
+	// ReplaceWith atomically replaces the entire content with what write
+	// writes to w and returns the new Version. If write returns an error, the
+	// content is left untouched. Caller must hold the lock from Lock.
+	ReplaceWith(write func(w io.Writer) error) (Version, error)
+}
+
+// SharedLockBackend is a Backend able to take a shared lock for reading. With
+// Options.SharedReadLock, loads are made holding the shared lock so that they
+// never overlap a writer holding the exclusive lock from Lock. A Backend not
+// implementing SharedLockBackend is read without a lock.
+type SharedLockBackend interface {
+	Backend
+	// RLock blocks until a shared lock is acquired. Any number of readers
+	// (in this and other processes) can hold the shared lock at the same
+	// time, but not while the exclusive lock from Lock is held.
+	RLock() error
+	// RUnlock releases a shared lock acquired by RLock.
+	RUnlock() error
+}
+
+// backendRef is stored in anyStore.backend as atomic.Value requires all
+// stored values to be of the same concrete type.
+type backendRef struct {
+	Backend
+}
+
+// storage returns the Backend of the store.
+func (a *anyStore) storage() (Backend, error) {
+	ref, ok := a.backend.Load().(backendRef)
+	if !ok || ref.Backend == nil {
+		return nil, errors.New("persistence not set")
+	}
+	return ref.Backend, nil
+}
+
+// setStorage replaces the Backend of the store.
+func (a *anyStore) setStorage(b Backend) {
+	a.backend.Store(backendRef{b})
+	a.invalidateCache()
+}
+
+// fileBackend is the default Backend storing the content in a file replaced
+// via rename and locked using flock(2) on a lockfile next to it.
+type fileBackend struct {
+	file   string
+	mutex  sync.Mutex
+	lockfd int
+
+	// Readers holding the shared lock on rlockfd (see RLock).
+	rmutex  sync.Mutex
+	readers int
+	rlockfd int
+}
+
+// NewFileBackend returns a Backend storing the content in file, the default
+// Backend of AnyStore (see Options.PersistenceFile). file can start with tilde
+// for HOME resolution, the directory path is created (os.MkdirAll) if it does
+// not exist. Content is replaced by saving a temporary file along-side the
+// original and renaming it to file (rename is atomic). Lock locks a lockfile
+// (file + ".lock") using syscall.Flock (LOCK_EX), RLock takes a shared lock
+// (LOCK_SH) on it. Close removes the lockfile while holding the exclusive
+// lock.
+func NewFileBackend(file string) (Backend, error) {
+	// If persistence file starts with a tilde, resolve it to the user's home
+	// directory.
+	file, err := expandHome(file)
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := filepath.Split(file)
+	if dir != "" && dir != "." && dir != ".." {
+		if _, err := os.Stat(dir); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				if err := os.MkdirAll(dir, 0777); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	} else {
+		f.Close()
+	}
+	return &fileBackend{file: file}, nil
+}
+
+func (b *fileBackend) Lock() error {
+	b.mutex.Lock()
+	lockfd, err := lockFile(b.file+".lock", syscall.LOCK_EX)
+	if err != nil {
+		b.mutex.Unlock()
+		return err
+	}
+	b.lockfd = lockfd
+	return nil
+}
+
+func (b *fileBackend) Unlock() error {
+	err := syscall.Close(b.lockfd)
+	b.mutex.Unlock()
+	return err
+}
+
+// RLock takes the shared lock once for all concurrent readers of the backend,
+// it is released when the last reader calls RUnlock.
+func (b *fileBackend) RLock() error {
+	b.rmutex.Lock()
+	defer b.rmutex.Unlock()
+	if b.readers == 0 {
+		lockfd, err := lockFile(b.file+".lock", syscall.LOCK_SH)
+		if err != nil {
+			return err
+		}
+		b.rlockfd = lockfd
+	}
+	b.readers++
+	return nil
+}
+
+func (b *fileBackend) RUnlock() error {
+	b.rmutex.Lock()
+	defer b.rmutex.Unlock()
+	if b.readers == 0 {
+		return errors.New("RUnlock of unlocked backend")
+	}
+	b.readers--
+	if b.readers == 0 {
+		return syscall.Close(b.rlockfd)
+	}
+	return nil
+}
+
+func (b *fileBackend) Version() (Version, error) {
+	id, err := identify(b.file)
+	if err != nil {
+		return "", err
+	}
+	return id.version(), nil
+}
+
+func (b *fileBackend) ReadAll() ([]byte, Version, error) {
+	return b.ReadFrom(0)
+}
+
+func (b *fileBackend) ReadFrom(offset int64) ([]byte, Version, error) {
+	f, err := os.OpenFile(b.file, os.O_RDONLY, 0666)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer f.Close()
+	id, err := identifyFile(f)
+	if err != nil {
+		return nil, "", err
+	}
+	if offset >= id.size {
+		return nil, id.version(), nil
+	}
+	data := make([]byte, id.size-offset)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	return data[:n], id.version(), nil
+}
+
+func (b *fileBackend) Open() (io.ReadCloser, Version, error) {
+	f, err := os.OpenFile(b.file, os.O_RDONLY, 0666)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	id, err := identifyFile(f)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, id.version(), nil
+}
+
+func (b *fileBackend) Replace(data []byte) (Version, error) {
+	id, err := replaceFile(b.file, func(w io.Writer) error {
+		if n, err := w.Write(data); err != nil {
+			return err
+		} else if n != len(data) {
+			return ErrWroteTooLittle
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.version(), nil
+}
+
+func (b *fileBackend) ReplaceWith(write func(w io.Writer) error) (Version, error) {
+	id, err := replaceFile(b.file, write)
+	if err != nil {
+		return "", err
+	}
+	return id.version(), nil
+}
+
+func (b *fileBackend) Append(offset int64, data []byte) (Version, error) {
+	f, err := os.OpenFile(b.file, os.O_RDWR, 0666)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return "", err
+	} else if fi.Size() > offset {
+		if err := f.Truncate(offset); err != nil {
+			return "", err
+		}
+	}
+	if n, err := f.WriteAt(data, offset); err != nil {
+		return "", err
+	} else if n != len(data) {
+		return "", ErrWroteTooLittle
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	id, err := identifyFile(f)
+	if err != nil {
+		return "", err
+	}
+	return id.version(), nil
+}
+
+// Close removes the lockfile. The lockfile is removed while holding the
+// exclusive lock, never while a writer (or reader) of another process holds
+// it, as that process would otherwise keep a lock on the removed file while
+// the next process locks a new lockfile.
+func (b *fileBackend) Close() error {
+	lockfile := b.file + ".lock"
+	_, err := os.Stat(lockfile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := b.Lock(); err != nil {
+		return err
+	}
+	defer b.Unlock()
+	if err := os.Remove(lockfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// expandHome resolves a file starting with tilde to the user's home
+// directory.
+func expandHome(file string) (string, error) {
+	if strings.HasPrefix(file, "~/") {
+		dirname, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dirname, file[2:]), nil
+	}
+	return file, nil
+}
+
+// lockFile locks lockfile using syscall.Flock, how is syscall.LOCK_EX
+// (exclusive) or syscall.LOCK_SH (shared). Closing the returned file
+// descriptor unlocks it.
+func lockFile(lockfile string, how int) (int, error) {
+	for {
+		lockfd, err := syscall.Open(lockfile, syscall.O_CREAT|syscall.O_RDWR, 0666)
+		if err != nil {
+			return -1, err
+		}
+		if err := syscall.Flock(lockfd, how); err != nil {
+			syscall.Close(lockfd)
+			return -1, err
+		}
+		var stat_t syscall.Stat_t
+		if err := syscall.Fstat(lockfd, &stat_t); err != nil {
+			syscall.Close(lockfd)
+			return -1, err
+		}
+		if stat_t.Nlink == 0 {
+			// File deleted (no hard links), recreate it
+			syscall.Close(lockfd)
+			continue
+		}
+		// We should have a lockfd with an existing file at this point
+		return lockfd, nil
+	}
+}
+
+// replaceFile saves what write writes as a temporary file along-side the
+// original and replaces the main file via rename (as rename is atomic, it will
+// not corrupt the main file in the event of a crash). Returns the fileID of
+// the new file.
+func replaceFile(file string, write func(w io.Writer) error) (fileID, error) {
+	unlink := true
+	newFilename := file + "." + rndstr(10)
+	tmpf, err := os.OpenFile(newFilename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return fileID{}, err
+	}
+	defer func() {
+		if unlink {
+			os.Remove(newFilename)
+		}
+	}()
+	bw := bufio.NewWriter(tmpf)
+	if err := write(bw); err != nil {
+		tmpf.Close()
+		return fileID{}, err
+	}
+	if err := bw.Flush(); err != nil {
+		tmpf.Close()
+		return fileID{}, err
+	}
+	tmpf.Sync()
+	id, err := identifyFile(tmpf)
+	tmpf.Close()
+	if err != nil {
+		return fileID{}, err
+	}
+	if err := os.Rename(newFilename, file); err != nil {
+		return fileID{}, err
+	}
+	unlink = false
+	return id, nil
+}
+
+// tailSize is the number of bytes at the end of the persistence file included
+// in a fileID. The tail of an encrypted file is effectively random and
+// different for every write, which protects the identity against inode
+// reuse in combination with coarse modification times.
+const tailSize = 32
+
+// fileID identifies a specific version of a file. As the persistence file is
+// always replaced via rename, a new version has a new inode, but an inode can
+// be reused and modification times can be coarse. The tail of the file is
+// therefore included.
+type fileID struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+	tail  [tailSize]byte
+}
+
+// version returns id as a Version, the zero fileID (missing file) returns the
+// zero Version.
+func (id fileID) version() Version {
+	if id == (fileID{}) {
+		return ""
+	}
+	buf := make([]byte, 32, 32+tailSize)
+	binary.BigEndian.PutUint64(buf[0:], id.dev)
+	binary.BigEndian.PutUint64(buf[8:], id.ino)
+	binary.BigEndian.PutUint64(buf[16:], uint64(id.size))
+	binary.BigEndian.PutUint64(buf[24:], uint64(id.mtime))
+	return Version(append(buf, id.tail[:]...))
+}
+
+// identify returns the fileID of file. A missing file returns the zero
+// fileID.
+func identify(file string) (fileID, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fileID{}, nil
+		}
+		return fileID{}, err
+	}
+	defer f.Close()
+	return identifyFile(f)
+}
+
+// identifyFile returns the fileID of an open file without moving the file
+// offset.
+func identifyFile(f *os.File) (fileID, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return fileID{}, err
+	}
+	id := fileID{
+		size:  fi.Size(),
+		mtime: fi.ModTime().UnixNano(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		id.dev = uint64(st.Dev)
+		id.ino = uint64(st.Ino)
+	}
+	offset := id.size - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.ReadAt(id.tail[:id.size-offset], offset); err != nil && !errors.Is(err, io.EOF) {
+		return fileID{}, err
+	}
+	return id, nil
+}
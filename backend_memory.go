@@ -0,0 +1,255 @@
+package anystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrInvalidLengthPrefix error = errors.New("length prefix exceeds the content of the io.ReadWriteSeeker (corrupt data)")
+)
+
+// memoryBackend is a Backend keeping the content in memory.
+type memoryBackend struct {
+	lock    sync.Mutex
+	mutex   sync.Mutex
+	data    []byte
+	version uint64
+}
+
+// NewMemoryBackend returns a Backend keeping the (still encrypted) content in
+// memory, e.g for tests. The Backend can be shared by several AnyStores in the
+// same process, but not between processes.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{}
+}
+
+func (b *memoryBackend) Lock() error {
+	b.lock.Lock()
+	return nil
+}
+
+func (b *memoryBackend) Unlock() error {
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *memoryBackend) Version() (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.current(), nil
+}
+
+func (b *memoryBackend) ReadAll() ([]byte, Version, error) {
+	return b.ReadFrom(0)
+}
+
+func (b *memoryBackend) ReadFrom(offset int64) ([]byte, Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if offset >= int64(len(b.data)) {
+		return nil, b.current(), nil
+	}
+	// Content is never modified in place, see Append.
+	return b.data[offset:len(b.data):len(b.data)], b.current(), nil
+}
+
+func (b *memoryBackend) Replace(data []byte) (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(make([]byte, 0, len(data)), data...)
+	b.version++
+	return b.current(), nil
+}
+
+func (b *memoryBackend) Append(offset int64, data []byte) (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if offset > int64(len(b.data)) {
+		return "", io.ErrUnexpectedEOF
+	}
+	// The three-index slice forces a copy, previously returned content is
+	// left untouched.
+	b.data = append(b.data[:offset:offset], data...)
+	b.version++
+	return b.current(), nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+// current returns the current Version, caller must hold b.mutex.
+func (b *memoryBackend) current() Version {
+	if b.data == nil {
+		return ""
+	}
+	return Version(strconv.FormatUint(b.version, 10))
+}
+
+// readWriteSeekerBackend is a Backend storing the content in an
+// io.ReadWriteSeeker prefixed by its length.
+type readWriteSeekerBackend struct {
+	lock    sync.Mutex
+	mutex   sync.Mutex
+	rws     io.ReadWriteSeeker
+	version uint64
+}
+
+// lengthPrefixSize is the size of the big-endian length prefix of the content
+// in an io.ReadWriteSeeker Backend.
+const lengthPrefixSize = 8
+
+// NewReadWriteSeekerBackend returns a Backend storing the content in rws, e.g
+// a file handle or a buffer in an embedded device. As an io.ReadWriteSeeker
+// can not be truncated, the content is prefixed by its length as an 8 byte
+// big-endian integer and anything beyond it is ignored. An empty rws has no
+// content. Locking and versioning is in-process only, rws must not be
+// modified by anything other than the returned Backend. Close does not close
+// rws.
+//
+// The backend is not crash-atomic: Replace overwrites the content (and the
+// length prefix) in place, a failed or interrupted write (e.g a power loss)
+// can leave a length prefix beyond the end of rws, failing every read with
+// ErrInvalidLengthPrefix, or new data mixed with old data, failing
+// authentication (e.g ErrAuthenticationFailed) on the next load. Either way
+// the store can not be loaded again. Appends are safer as the length prefix is only updated after
+// the record has been written (see Options.AppendOnly), but compaction still
+// uses Replace. Keep a backup or use NewFileBackend if the content must
+// survive crashes.
+func NewReadWriteSeekerBackend(rws io.ReadWriteSeeker) Backend {
+	return &readWriteSeekerBackend{rws: rws}
+}
+
+func (b *readWriteSeekerBackend) Lock() error {
+	b.lock.Lock()
+	return nil
+}
+
+func (b *readWriteSeekerBackend) Unlock() error {
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *readWriteSeekerBackend) Version() (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.current(), nil
+}
+
+func (b *readWriteSeekerBackend) ReadAll() ([]byte, Version, error) {
+	return b.ReadFrom(0)
+}
+
+func (b *readWriteSeekerBackend) ReadFrom(offset int64) ([]byte, Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	size, err := b.size()
+	if err != nil {
+		return nil, "", err
+	}
+	if offset >= size {
+		return nil, b.current(), nil
+	}
+	if _, err := b.rws.Seek(lengthPrefixSize+offset, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	data := make([]byte, size-offset)
+	if _, err := io.ReadFull(b.rws, data); err != nil {
+		return nil, "", err
+	}
+	return data, b.current(), nil
+}
+
+// Replace overwrites the content in place, it is not atomic (see
+// NewReadWriteSeekerBackend).
+func (b *readWriteSeekerBackend) Replace(data []byte) (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	buf := make([]byte, lengthPrefixSize, lengthPrefixSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(len(data)))
+	if err := b.writeAt(0, append(buf, data...)); err != nil {
+		return "", err
+	}
+	b.version++
+	return b.current(), nil
+}
+
+func (b *readWriteSeekerBackend) Append(offset int64, data []byte) (Version, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	size, err := b.size()
+	if err != nil {
+		return "", err
+	}
+	if offset > size {
+		return "", io.ErrUnexpectedEOF
+	}
+	// Write the data first, the content does not include it until the length
+	// prefix has been updated.
+	if err := b.writeAt(lengthPrefixSize+offset, data); err != nil {
+		return "", err
+	}
+	prefix := make([]byte, lengthPrefixSize)
+	binary.BigEndian.PutUint64(prefix, uint64(offset)+uint64(len(data)))
+	if err := b.writeAt(0, prefix); err != nil {
+		return "", err
+	}
+	b.version++
+	return b.current(), nil
+}
+
+func (b *readWriteSeekerBackend) Close() error {
+	return nil
+}
+
+// size returns the length of the content, caller must hold b.mutex. A length
+// prefix beyond the end of rws returns ErrInvalidLengthPrefix.
+func (b *readWriteSeekerBackend) size() (int64, error) {
+	end, err := b.rws.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := b.rws.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	prefix := make([]byte, lengthPrefixSize)
+	if _, err := io.ReadFull(b.rws, prefix); err != nil {
+		if errors.Is(err, io.EOF) {
+			// Empty, no content.
+			return 0, nil
+		}
+		return 0, err
+	}
+	size := binary.BigEndian.Uint64(prefix)
+	if size > uint64(end-int64(lengthPrefixSize)) {
+		return 0, fmt.Errorf("%w: %d bytes, %d available", ErrInvalidLengthPrefix, size, end-int64(lengthPrefixSize))
+	}
+	return int64(size), nil
+}
+
+// writeAt writes data at offset of rws and syncs it if rws can be synced.
+// Caller must hold b.mutex.
+func (b *readWriteSeekerBackend) writeAt(offset int64, data []byte) error {
+	if _, err := b.rws.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if n, err := b.rws.Write(data); err != nil {
+		return err
+	} else if n != len(data) {
+		return ErrWroteTooLittle
+	}
+	if syncer, ok := b.rws.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// current returns the current Version, caller must hold b.mutex.
+func (b *readWriteSeekerBackend) current() Version {
+	return Version(strconv.FormatUint(b.version, 10))
+}
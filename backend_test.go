@@ -0,0 +1,444 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/anystore"
+)
+
+// seekBuffer is an in-memory io.ReadWriteSeeker.
+type seekBuffer struct {
+	data   []byte
+	offset int64
+}
+
+func (b *seekBuffer) Read(p []byte) (int, error) {
+	if b.offset >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.offset:])
+	b.offset += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.offset + int64(len(p)); end > int64(len(b.data)) {
+		b.data = append(b.data, make([]byte, end-int64(len(b.data)))...)
+	}
+	n := copy(b.data[b.offset:], p)
+	b.offset += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += int64(len(b.data))
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func testBackend(t *testing.T, backend anystore.Backend, appendOnly bool) {
+	t.Helper()
+	options := &anystore.Options{
+		EnablePersistence: true,
+		Backend:           backend,
+		EncryptionKey:     anystore.NewKey(),
+		AppendOnly:        appendOnly,
+	}
+	a, err := anystore.NewAnyStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StoreMany(map[any]any{"hello": "world", "counter": 0, "big": make([]byte, 4096)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := b.Store("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Shrink the content.
+	if err := a.Delete("big"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 5 {
+		t.Errorf("expected 5, got %v", v)
+	}
+	if b.HasKey("big") {
+		t.Error("expected big to be deleted")
+	}
+	if l, err := b.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 2 {
+		t.Errorf("expected Len() == 2, got %d", l)
+	}
+	if err := a.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewMemoryBackend(t *testing.T) {
+	testBackend(t, anystore.NewMemoryBackend(), false)
+	testBackend(t, anystore.NewMemoryBackend(), true)
+}
+
+func TestNewReadWriteSeekerBackend(t *testing.T) {
+	for _, appendOnly := range []bool{false, true} {
+		testBackend(t, anystore.NewReadWriteSeekerBackend(&seekBuffer{}), appendOnly)
+		// A new backend on the same storage reads the content back.
+		buf := &seekBuffer{}
+		key := anystore.NewKey()
+		a, err := anystore.NewAnyStore(&anystore.Options{
+			EnablePersistence: true,
+			Backend:           anystore.NewReadWriteSeekerBackend(buf),
+			EncryptionKey:     key,
+			AppendOnly:        appendOnly,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Store("persisted", true); err != nil {
+			t.Fatal(err)
+		}
+		b, err := anystore.NewAnyStore(&anystore.Options{
+			EnablePersistence: true,
+			Backend:           anystore.NewReadWriteSeekerBackend(buf),
+			EncryptionKey:     key,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := b.Load("persisted"); err != nil {
+			t.Fatal(err)
+		} else if v != true {
+			t.Errorf("expected true, got %v", v)
+		}
+	}
+}
+
+func TestNewReadWriteSeekerBackend_invalidLengthPrefix(t *testing.T) {
+	prefixes := [][]byte{
+		{0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09},
+	}
+	for _, prefix := range prefixes {
+		buf := &seekBuffer{data: append(append([]byte(nil), prefix...), "8 bytes!"...)}
+		a, err := anystore.NewAnyStore(&anystore.Options{
+			EnablePersistence: true,
+			Backend:           anystore.NewReadWriteSeekerBackend(buf),
+			EncryptionKey:     anystore.NewKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Load("key"); !errors.Is(err, anystore.ErrInvalidLengthPrefix) {
+			t.Errorf("%x: expected ErrInvalidLengthPrefix, got %v", prefix, err)
+		}
+		// The corrupt content is not silently replaced.
+		if err := a.Store("key", "value"); !errors.Is(err, anystore.ErrInvalidLengthPrefix) {
+			t.Errorf("%x: expected ErrInvalidLengthPrefix, got %v", prefix, err)
+		}
+	}
+}
+
+// Environment of the processes started by TestSharedReadLock_MultiProcess.
+const (
+	sharedLockRoleEnv = "ANYSTORE_SHARED_LOCK_ROLE"
+	sharedLockFileEnv = "ANYSTORE_SHARED_LOCK_FILE"
+	sharedLockIDEnv   = "ANYSTORE_SHARED_LOCK_ID"
+)
+
+func TestSharedReadLock_MultiProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping multi-process test in short mode")
+	}
+	file := filepath.Join(t.TempDir(), "shared")
+	seed, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Store("sentinel", "present"); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	start := func(role string, id int) (*exec.Cmd, *bytes.Buffer) {
+		return startSharedLockHelper(t, role, file, id)
+	}
+	type process struct {
+		name   string
+		cmd    *exec.Cmd
+		output *bytes.Buffer
+	}
+	var writers, readers []process
+	for i := 0; i < 3; i++ {
+		cmd, output := start("writer", i)
+		writers = append(writers, process{fmt.Sprintf("writer %d", i), cmd, output})
+	}
+	for i := 0; i < 3; i++ {
+		cmd, output := start("reader", i)
+		readers = append(readers, process{fmt.Sprintf("reader %d", i), cmd, output})
+	}
+	for _, p := range writers {
+		if err := p.cmd.Wait(); err != nil {
+			t.Errorf("%s: %v\n%s", p.name, err, p.output)
+		}
+	}
+	// Readers loop until the writers are done.
+	if err := os.WriteFile(file+".done", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range readers {
+		if err := p.cmd.Wait(); err != nil {
+			t.Errorf("%s: %v\n%s", p.name, err, p.output)
+		}
+	}
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if expected := 1 + 3*sharedLockWrites; n != expected {
+		t.Errorf("expected %d keys, got %d", expected, n)
+	}
+}
+
+// startSharedLockHelper starts TestSharedReadLockHelper as a process in role
+// on file, the returned buffer collects its output.
+func startSharedLockHelper(t *testing.T, role, file string, id int) (*exec.Cmd, *bytes.Buffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSharedReadLockHelper$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		sharedLockRoleEnv+"="+role,
+		sharedLockFileEnv+"="+file,
+		sharedLockIDEnv+"="+strconv.Itoa(id),
+	)
+	// Stdout and Stderr are the same writer, exec does not write to it
+	// concurrently.
+	output := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, output
+}
+
+func TestSharedReadLock_BlocksOnWriter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping multi-process test in short mode")
+	}
+	file := filepath.Join(t.TempDir(), "shared")
+	seed, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Store("sentinel", "present"); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Act as a writer holding the exclusive lock while the file is half
+	// written (written in place rather than renamed).
+	lockfd, err := syscall.Open(file+".lock", syscall.O_CREAT|syscall.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(lockfd)
+	if err := syscall.Flock(lockfd, syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, saved[:len(saved)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd, output := startSharedLockHelper(t, "blocked-reader", file, 0)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	// The reader signals it is about to load, it must then block on the
+	// shared lock instead of reading the half written file.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(file + ".ready"); err == nil {
+			break
+		}
+		select {
+		case err := <-exited:
+			t.Fatalf("reader exited before loading: %v\n%s", err, output)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the reader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("reader did not wait for the exclusive lock: %v\n%s", err, output)
+	case <-time.After(300 * time.Millisecond):
+	}
+	// Complete the write and release the lock, the reader then loads the
+	// complete file.
+	if err := os.WriteFile(file, saved, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(lockfd, syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("reader: %v\n%s", err, output)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the reader to load")
+	}
+}
+
+// sharedLockWrites is the number of keys stored by each writer process.
+const sharedLockWrites = 100
+
+// TestSharedReadLockHelper is run as a writer or reader process by
+// TestSharedReadLock_MultiProcess. Writers run the workload of
+// FuzzConcurrentPersistence, reopening the store now and then. Readers use
+// Options.SharedReadLock and fail if the sentinel key is ever missing or the
+// number of keys ever decreases. A blocked-reader (see
+// TestSharedReadLock_BlocksOnWriter) loads the sentinel key once.
+func TestSharedReadLockHelper(t *testing.T) {
+	role := os.Getenv(sharedLockRoleEnv)
+	if role == "" {
+		t.Skip("only run by TestSharedReadLock_MultiProcess")
+	}
+	file := os.Getenv(sharedLockFileEnv)
+	id, err := strconv.Atoi(os.Getenv(sharedLockIDEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(gzip bool) anystore.AnyStore {
+		a, err := anystore.NewAnyStore(&anystore.Options{
+			EnablePersistence:   true,
+			PersistenceFile:     file,
+			GZipPersistenceFile: gzip,
+			SharedReadLock:      role != "writer",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	switch role {
+	case "writer":
+		a := open(id%2 == 0)
+		for i := 0; i < sharedLockWrites; i++ {
+			key := fmt.Sprintf("writer-%d-%d", id, i)
+			if err := a.Store(key, "hello world"); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := a.Load(key); err != nil {
+				t.Fatal(err)
+			} else if v != "hello world" {
+				t.Fatalf("expected hello world, got %v", v)
+			}
+			if i%10 == 9 {
+				if err := a.Close(); err != nil {
+					t.Fatal(err)
+				}
+				a = open(i%20 == 9)
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "reader":
+		a := open(false)
+		last := 0
+		for i := 0; ; i++ {
+			if _, err := os.Stat(file + ".done"); err == nil {
+				break
+			}
+			if v, err := a.Load("sentinel"); err != nil {
+				t.Fatalf("load %d: %v", i, err)
+			} else if v != "present" {
+				t.Fatalf("load %d: expected present, got %v", i, v)
+			}
+			n, err := a.Len()
+			if err != nil {
+				t.Fatalf("len %d: %v", i, err)
+			}
+			if n < last {
+				t.Fatalf("len %d: number of keys decreased from %d to %d", i, last, n)
+			}
+			last = n
+			if i%50 == 49 {
+				if err := a.Close(); err != nil {
+					t.Fatal(err)
+				}
+				a = open(false)
+			}
+			if i > 1e6 {
+				t.Fatal("writers never finished")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "blocked-reader":
+		a := open(false)
+		if err := os.WriteFile(file+".ready", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := a.Load("sentinel"); err != nil {
+			t.Fatal(err)
+		} else if v != "present" {
+			t.Fatalf("expected present, got %v", v)
+		}
+	default:
+		t.Fatalf("unknown role %q", role)
+	}
+}
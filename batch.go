@@ -0,0 +1,118 @@
+package anystore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnknownOp error = errors.New("unknown operation")
+
+// OpType is the type of operation in an Op.
+type OpType int
+
+const (
+	OpStore OpType = iota
+	OpDelete
+)
+
+func (o OpType) String() string {
+	switch o {
+	case OpStore:
+		return "store"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("OpType(%d)", int(o))
+}
+
+// Op is a single operation in a batch executed by AnyStore.Apply. Value and
+// TTL are ignored for OpDelete. TTL works as in AnyStore.StoreWithTTL.
+type Op struct {
+	Type  OpType
+	Key   any
+	Value any
+	TTL   time.Duration
+}
+
+func (a *anyStore) StoreMany(kv map[any]any) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.storeMany(kv)
+}
+
+func (a *anyStore) DeleteMany(keys []any) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.deleteMany(keys)
+}
+
+func (a *anyStore) Apply(ops []Op) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.apply(ops)
+}
+
+func (u *unsafeAnyStore) StoreMany(kv map[any]any) error {
+	return u.storeMany(kv)
+}
+
+func (u *unsafeAnyStore) DeleteMany(keys []any) error {
+	return u.deleteMany(keys)
+}
+
+func (u *unsafeAnyStore) Apply(ops []Op) error {
+	return u.apply(ops)
+}
+
+func (a *anyStore) storeMany(kv map[any]any) error {
+	if len(kv) == 0 {
+		return nil
+	}
+	return a.mutate(func(kvN anyMap) (bool, error) {
+		for k, v := range kv {
+			kvN[k] = a.expiring(v, 0)
+		}
+		return true, nil
+	})
+}
+
+func (a *anyStore) deleteMany(keys []any) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.mutate(func(kvN anyMap) (bool, error) {
+		changed := false
+		for _, k := range keys {
+			if _, ok := kvN[k]; ok {
+				delete(kvN, k)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+func (a *anyStore) apply(ops []Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	for i := range ops {
+		switch ops[i].Type {
+		case OpStore, OpDelete:
+		default:
+			return fmt.Errorf("%w: %s (op %d)", ErrUnknownOp, ops[i].Type, i)
+		}
+	}
+	return a.mutate(func(kvN anyMap) (bool, error) {
+		for _, op := range ops {
+			switch op.Type {
+			case OpStore:
+				kvN[op.Key] = a.expiring(op.Value, op.TTL)
+			case OpDelete:
+				delete(kvN, op.Key)
+			}
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,104 @@
+package anystore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_StoreMany_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-batch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	kv := make(map[any]any)
+	for i := 0; i < 1000; i++ {
+		kv[i] = i * 2
+	}
+	if err := a.StoreMany(kv); err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := b.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 1000 {
+		t.Errorf("expected Len() == 1000, got %d", l)
+	}
+	if v, err := b.Load(500); err != nil {
+		t.Fatal(err)
+	} else if v != 1000 {
+		t.Errorf("expected 1000, got %v", v)
+	}
+	keys := make([]any, 0, 500)
+	for i := 0; i < 500; i++ {
+		keys = append(keys, i)
+	}
+	if err := b.DeleteMany(keys); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 500 {
+		t.Errorf("expected Len() == 500, got %d", l)
+	}
+}
+
+func TestAnyStore_Apply(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Apply([]anystore.Op{
+		{Type: anystore.OpStore, Key: "hola", Value: "mundo"},
+		{Type: anystore.OpDelete, Key: "hello"},
+		{Type: anystore.OpStore, Key: "hej", Value: "världen"},
+		{Type: anystore.OpStore, Key: "hej", Value: "hela världen"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if a.HasKey("hello") {
+		t.Error("expected hello to be deleted")
+	}
+	if v, err := a.Load("hej"); err != nil {
+		t.Fatal(err)
+	} else if v != "hela världen" {
+		t.Errorf("expected last op to win, got %v", v)
+	}
+	err = a.Apply([]anystore.Op{
+		{Type: anystore.OpDelete, Key: "hola"},
+		{Type: anystore.OpType(99), Key: "hola"},
+	})
+	if !errors.Is(err, anystore.ErrUnknownOp) {
+		t.Errorf("expected ErrUnknownOp, got %v", err)
+	}
+	if !a.HasKey("hola") {
+		t.Error("expected no operation to be applied from an invalid batch")
+	}
+}
@@ -0,0 +1,45 @@
+package anystore
+
+import (
+	"reflect"
+)
+
+// persistenceCache is the last decoded version of the persistence file. log
+// is nil unless the file is an append-only log.
+type persistenceCache struct {
+	version Version
+	kv      anyMap
+	log     *logState
+}
+
+// cached returns the version of the persistence file last decoded (or saved)
+// or nil if there is none.
+func (a *anyStore) cached() *persistenceCache {
+	c, _ := a.cache.Load().(*persistenceCache)
+	return c
+}
+
+// setCache remembers c as the decoded content of the persistence file.
+func (a *anyStore) setCache(c *persistenceCache) {
+	a.cache.Store(c)
+}
+
+// invalidateCache forces the next load to read and decode the persistence
+// file, e.g after changing the encryption key.
+func (a *anyStore) invalidateCache() {
+	a.cache.Store((*persistenceCache)(nil))
+}
+
+// clone returns a shallow copy of m.
+func (m anyMap) clone() anyMap {
+	kvN := make(anyMap, len(m))
+	for k, v := range m {
+		kvN[k] = v
+	}
+	return kvN
+}
+
+// sameMap returns true if x and y are the same map (not only equal).
+func sameMap(x, y anyMap) bool {
+	return reflect.ValueOf(x).Pointer() == reflect.ValueOf(y).Pointer()
+}
@@ -0,0 +1,96 @@
+package anystore_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Load_cache(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-cache-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	secret := anystore.NewKey()
+	writer, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes of the same size in quick succession must never be served from a
+	// stale cache.
+	for i := 0; i < 100; i++ {
+		value := fmt.Sprintf("value-%03d", i)
+		if err := writer.Store("key", value); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			if v, err := reader.Load("key"); err != nil {
+				t.Fatal(err)
+			} else if v != value {
+				t.Fatalf("expected %q, got %q", value, v)
+			}
+		}
+	}
+	// Changing the encryption key invalidates the cache.
+	if _, err := reader.SetEncryptionKey(anystore.NewKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Load("key"); err == nil {
+		t.Error("expected error loading with wrong encryption key")
+	}
+}
+
+func BenchmarkLoadPersistence(b *testing.B) {
+	f, err := os.CreateTemp("", "anystore-benchmark-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	kv := make(map[any]any)
+	for i := 0; i < 1000; i++ {
+		kv[i] = fmt.Sprintf("value-%d", i)
+	}
+	if err := a.StoreMany(kv); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if v, err := a.Load(i % 1000); err != nil {
+			b.Fatal(err)
+		} else if v == nil {
+			b.Fatal("value not found")
+		}
+	}
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 
 	"github.com/sa6mwa/anystore"
 )
 
 func main() {
+	keypair := flag.Bool("keypair", false, "generate a X25519 identity (private key) and recipient (public key) for stashes")
+	flag.Parse()
+	if *keypair {
+		identity, recipient, err := anystore.NewKeyPair()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("identity: %s\nrecipient: %s\n", identity, recipient)
+		return
+	}
 	fmt.Println(anystore.NewKey())
 }
@@ -0,0 +1,393 @@
+package anystore
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Codec serializes the persisted map (and the Thing of a stash) before it is
+// optionally compressed and encrypted. The ID of the codec is recorded in the
+// header of the persisted data so that readers pick the right decoder
+// automatically (see Options.Codec). GobCodec is the default.
+//
+// Encode and Decode work like gob or json encoders and decoders, Decode is
+// given a pointer. Codecs other than GobCodec receive the map as a list of
+// entries (a slice of structs with the fields Key, Value and Expires) as map
+// keys can be of any type.
+type Codec interface {
+	// ID identifies the codec in the header of persisted data. IDs below 128
+	// are reserved for the codecs of this package.
+	ID() byte
+	Encode(w io.Writer, v any) error
+	Decode(r io.Reader, v any) error
+}
+
+// IDs of the codecs of this package.
+const (
+	codecGob    byte = 1
+	codecJSON   byte = 2
+	codecBinary byte = 3
+)
+
+var (
+	// GobCodec encodes using encoding/gob. Values keep their Go types, custom
+	// types must be registered using gob.Register.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes using encoding/json. Values decode as the generic
+	// JSON types (string, float64, bool, nil, []any and map[string]any),
+	// values of other types do not round trip. Keys must be of type string,
+	// float64 or bool (ErrCodecKeyType). Useful for persistence files that
+	// are read by other programs.
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec is a compact, self-describing binary encoding (similar to
+	// CBOR). Booleans, integers, floats, strings, byte slices, slices, maps
+	// and time.Time keep their types, structs are encoded as maps of their
+	// exported fields and decode as map[any]any. Keys must be of type bool,
+	// string or one of the predeclared integer and float types
+	// (ErrCodecKeyType).
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var (
+	ErrUnknownCodec error = errors.New("unknown codec")
+	ErrCodecKeyType error = errors.New("key type does not round trip using the codec")
+)
+
+// codecByID returns the codec with id, configured if it is the codec of the
+// store, or one of the codecs of this package.
+func codecByID(id byte, configured Codec) (Codec, error) {
+	if configured != nil && configured.ID() == id {
+		return configured, nil
+	}
+	switch id {
+	case codecGob:
+		return GobCodec, nil
+	case codecJSON:
+		return JSONCodec, nil
+	case codecBinary:
+		return BinaryCodec, nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownCodec, id)
+}
+
+// codecOf returns the codec recorded in header h, or GobCodec if none is
+// (data written by GobCodec does not record the codec).
+func codecOf(h header, configured Codec) (Codec, error) {
+	value, ok := h.get(tagCodec)
+	if !ok {
+		return GobCodec, nil
+	}
+	if len(value) != 1 {
+		return nil, fmt.Errorf("%w: invalid codec", ErrUnsupportedFormat)
+	}
+	return codecByID(value[0], configured)
+}
+
+// codecHeader returns the header field recording codec, none for GobCodec.
+func codecHeader(codec Codec) header {
+	if codec.ID() == codecGob {
+		return nil
+	}
+	return header{{tag: tagCodec, value: []byte{codec.ID()}}}
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return codecGob
+}
+
+func (gobCodec) Encode(w io.Writer, v any) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v any) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return codecJSON
+}
+
+func (jsonCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// codecEntry is a key/value pair of the map as given to codecs other than
+// GobCodec. Expires is the expiry of a value stored with a TTL (see
+// expiringValue).
+type codecEntry struct {
+	Key     any   `json:"key"`
+	Value   any   `json:"value"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// codecRecord is a logRecord as given to codecs other than GobCodec.
+type codecRecord struct {
+	Log      []byte       `json:"log"`
+	Snapshot []codecEntry `json:"snapshot,omitempty"`
+	Ops      []codecOp    `json:"ops,omitempty"`
+}
+
+// codecOp is a logOp as given to codecs other than GobCodec.
+type codecOp struct {
+	Key     any   `json:"key"`
+	Value   any   `json:"value,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+	Delete  bool  `json:"delete,omitempty"`
+}
+
+// toEntries converts kv into a list of entries. Keys of codecs of this package
+// are checked using checkKey.
+func toEntries(codec Codec, kv anyMap) ([]codecEntry, error) {
+	entries := make([]codecEntry, 0, len(kv))
+	for key, value := range kv {
+		if err := checkKey(codec, key); err != nil {
+			return nil, err
+		}
+		entry := codecEntry{Key: key, Value: value}
+		if e, ok := value.(expiringValue); ok {
+			entry.Value, entry.Expires = e.Value, e.Expires
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// checkKey returns ErrCodecKeyType if key does not decode back into an equal
+// key (of the same type) using JSONCodec or BinaryCodec, the key could
+// otherwise never be loaded again. JSONCodec decodes numbers as float64 and
+// time.Time as string, BinaryCodec keeps the predeclared types but not named
+// types, structs, arrays or pointers. Keys of custom codecs are not checked.
+func checkKey(codec Codec, key any) error {
+	if key == nil {
+		return nil
+	}
+	switch codec.ID() {
+	case codecJSON:
+		switch key.(type) {
+		case string, float64, bool:
+			return nil
+		}
+	case codecBinary:
+		switch key.(type) {
+		case bool, string,
+			int, int8, int16, int32, int64,
+			uint, uint8, uint16, uint32, uint64,
+			float32, float64:
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %T", ErrCodecKeyType, key)
+}
+
+// fromEntries converts a list of entries into kv.
+func fromEntries(kv anyMap, entries []codecEntry) error {
+	for _, entry := range entries {
+		if !isComparable(entry.Key) {
+			return fmt.Errorf("%w: decoded key of type %T is not comparable", ErrCodecKeyType, entry.Key)
+		}
+		kv[entry.Key] = entryValue(entry.Value, entry.Expires)
+	}
+	return nil
+}
+
+// entryValue wraps value in an expiringValue if expires is not zero.
+func entryValue(value any, expires int64) any {
+	if expires != 0 {
+		return expiringValue{Value: value, Expires: expires}
+	}
+	return value
+}
+
+// encodeValue encodes v (an anyMap or a logRecord) into w using codec.
+func encodeValue(codec Codec, w io.Writer, v any) error {
+	if codec.ID() == codecGob {
+		return codec.Encode(w, v)
+	}
+	switch t := v.(type) {
+	case anyMap:
+		entries, err := toEntries(codec, t)
+		if err != nil {
+			return err
+		}
+		return codec.Encode(w, entries)
+	case logRecord:
+		snapshot, err := toEntries(codec, t.Snapshot)
+		if err != nil {
+			return err
+		}
+		record := codecRecord{Log: t.Log[:], Snapshot: snapshot}
+		for _, op := range t.Ops {
+			if err := checkKey(codec, op.Key); err != nil {
+				return err
+			}
+			o := codecOp{Key: op.Key, Value: op.Value, Delete: op.Delete}
+			if e, ok := op.Value.(expiringValue); ok {
+				o.Value, o.Expires = e.Value, e.Expires
+			}
+			record.Ops = append(record.Ops, o)
+		}
+		return codec.Encode(w, record)
+	}
+	return codec.Encode(w, v)
+}
+
+// decodeValue decodes from r into v (a *anyMap or a *logRecord) using codec.
+func decodeValue(codec Codec, r io.Reader, v any) error {
+	if codec.ID() == codecGob {
+		return codec.Decode(r, v)
+	}
+	switch t := v.(type) {
+	case *anyMap:
+		var entries []codecEntry
+		if err := codec.Decode(r, &entries); err != nil {
+			return err
+		}
+		if *t == nil {
+			*t = make(anyMap, len(entries))
+		}
+		return fromEntries(*t, entries)
+	case *logRecord:
+		var record codecRecord
+		if err := codec.Decode(r, &record); err != nil {
+			return err
+		}
+		if len(record.Log) != logIDSize {
+			return fmt.Errorf("%w: invalid log ID", ErrCorruptLog)
+		}
+		copy(t.Log[:], record.Log)
+		if record.Snapshot != nil {
+			t.Snapshot = make(anyMap, len(record.Snapshot))
+			if err := fromEntries(t.Snapshot, record.Snapshot); err != nil {
+				return err
+			}
+		}
+		for _, o := range record.Ops {
+			if !isComparable(o.Key) {
+				return fmt.Errorf("%w: decoded key of type %T is not comparable", ErrCodecKeyType, o.Key)
+			}
+			t.Ops = append(t.Ops, logOp{Key: o.Key, Value: entryValue(o.Value, o.Expires), Delete: o.Delete})
+		}
+		return nil
+	}
+	return codec.Decode(r, v)
+}
+
+// assign sets dst to the generically decoded src (as decoded by JSONCodec or
+// BinaryCodec into an interface), converting maps into structs, slices and
+// maps of the type of dst and numbers into the numeric type of dst.
+func assign(dst reflect.Value, src any) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	sv := reflect.ValueOf(src)
+	if sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	case reflect.Struct:
+		if sv.Kind() != reflect.Map {
+			break
+		}
+		iter := sv.MapRange()
+		for iter.Next() {
+			name, ok := iter.Key().Interface().(string)
+			if !ok {
+				continue
+			}
+			field := dst.FieldByName(name)
+			if !field.IsValid() || !field.CanSet() {
+				continue
+			}
+			if err := assign(field, iter.Value().Interface()); err != nil {
+				return fmt.Errorf("%s.%w", name, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		if sv.Kind() != reflect.Map {
+			break
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), sv.Len())
+		iter := sv.MapRange()
+		for iter.Next() {
+			key := reflect.New(dst.Type().Key()).Elem()
+			if err := assign(key, iter.Key().Interface()); err != nil {
+				return err
+			}
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := assign(elem, iter.Value().Interface()); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		dst.Set(m)
+		return nil
+	case reflect.Slice, reflect.Array:
+		if sv.Kind() != reflect.Slice && sv.Kind() != reflect.Array {
+			break
+		}
+		n := sv.Len()
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.MakeSlice(dst.Type(), n, n))
+		} else if n != dst.Len() {
+			break
+		}
+		for i := 0; i < n; i++ {
+			if err := assign(dst.Index(i), sv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Bool, reflect.String:
+		if sv.Kind() == dst.Kind() {
+			dst.Set(sv.Convert(dst.Type()))
+			return nil
+		}
+	default:
+		if isNumeric(dst.Kind()) && isNumeric(sv.Kind()) {
+			dst.Set(sv.Convert(dst.Type()))
+			return nil
+		}
+	}
+	return fmt.Errorf("can not decode %T into %s", src, dst.Type())
+}
+
+// isNumeric returns true if k is an integer or floating point kind.
+func isNumeric(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// getCodec returns the codec of the store.
+func (a *anyStore) getCodec() Codec {
+	if a.codec == nil {
+		return GobCodec
+	}
+	return a.codec
+}
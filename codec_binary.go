@@ -0,0 +1,370 @@
+package anystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Type bytes of the BinaryCodec encoding. Each value starts with its type
+// byte followed by its payload:
+//
+//	nil, false, true     no payload
+//	signed integers      zig-zag varint
+//	unsigned integers    uvarint
+//	float32, float64     IEEE 754 bits, 4 or 8 bytes big-endian
+//	string, bytes        uvarint length followed by the bytes
+//	array                uvarint count followed by the values
+//	map                  uvarint count followed by the keys and values
+//	time                 uvarint length followed by time.Time.MarshalBinary
+const (
+	binNil     byte = 0x00
+	binFalse   byte = 0x01
+	binTrue    byte = 0x02
+	binInt     byte = 0x10
+	binInt8    byte = 0x11
+	binInt16   byte = 0x12
+	binInt32   byte = 0x13
+	binInt64   byte = 0x14
+	binUint    byte = 0x18
+	binUint8   byte = 0x19
+	binUint16  byte = 0x1a
+	binUint32  byte = 0x1b
+	binUint64  byte = 0x1c
+	binFloat32 byte = 0x20
+	binFloat64 byte = 0x21
+	binString  byte = 0x30
+	binBytes   byte = 0x31
+	binArray   byte = 0x40
+	binMap     byte = 0x41
+	binTime    byte = 0x50
+)
+
+const (
+	// binMaxDepth limits the nesting of decoded values.
+	binMaxDepth int = 512
+	// binMaxLength limits the length of decoded strings, byte slices, arrays
+	// and maps.
+	binMaxLength uint64 = 1 << 30
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type binaryCodec struct{}
+
+func (binaryCodec) ID() byte {
+	return codecBinary
+}
+
+func (binaryCodec) Encode(w io.Writer, v any) error {
+	bw := bufio.NewWriter(w)
+	e := &binEncoder{w: bw}
+	if err := e.encode(reflect.ValueOf(v), 0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (binaryCodec) Decode(r io.Reader, v any) error {
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Pointer || dst.IsNil() {
+		return ErrNotAPointer
+	}
+	br, ok := r.(binReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &binDecoder{r: br}
+	value, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	return assign(dst.Elem(), value)
+}
+
+// binReader is the reader of binDecoder.
+type binReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type binEncoder struct {
+	w       *bufio.Writer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *binEncoder) uvarint(tag byte, x uint64) {
+	e.w.WriteByte(tag)
+	e.w.Write(e.scratch[:binary.PutUvarint(e.scratch[:], x)])
+}
+
+func (e *binEncoder) varint(tag byte, x int64) {
+	e.w.WriteByte(tag)
+	e.w.Write(e.scratch[:binary.PutVarint(e.scratch[:], x)])
+}
+
+func (e *binEncoder) bytes(tag byte, b []byte) {
+	e.uvarint(tag, uint64(len(b)))
+	e.w.Write(b)
+}
+
+func (e *binEncoder) encode(v reflect.Value, depth int) error {
+	if depth > binMaxDepth {
+		return errors.New("value nested too deeply")
+	}
+	if !v.IsValid() {
+		return e.w.WriteByte(binNil)
+	}
+	if v.Type() == timeType {
+		b, err := v.Interface().(time.Time).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.bytes(binTime, b)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return e.w.WriteByte(binNil)
+		}
+		return e.encode(v.Elem(), depth+1)
+	case reflect.Bool:
+		if v.Bool() {
+			return e.w.WriteByte(binTrue)
+		}
+		return e.w.WriteByte(binFalse)
+	case reflect.Int:
+		e.varint(binInt, v.Int())
+	case reflect.Int8:
+		e.varint(binInt8, v.Int())
+	case reflect.Int16:
+		e.varint(binInt16, v.Int())
+	case reflect.Int32:
+		e.varint(binInt32, v.Int())
+	case reflect.Int64:
+		e.varint(binInt64, v.Int())
+	case reflect.Uint, reflect.Uintptr:
+		e.uvarint(binUint, v.Uint())
+	case reflect.Uint8:
+		e.uvarint(binUint8, v.Uint())
+	case reflect.Uint16:
+		e.uvarint(binUint16, v.Uint())
+	case reflect.Uint32:
+		e.uvarint(binUint32, v.Uint())
+	case reflect.Uint64:
+		e.uvarint(binUint64, v.Uint())
+	case reflect.Float32:
+		e.w.WriteByte(binFloat32)
+		e.w.Write(binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v.Float()))))
+	case reflect.Float64:
+		e.w.WriteByte(binFloat64)
+		e.w.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())))
+	case reflect.String:
+		e.uvarint(binString, uint64(v.Len()))
+		e.w.WriteString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.bytes(binBytes, b)
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return e.w.WriteByte(binNil)
+		}
+		e.uvarint(binArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return e.w.WriteByte(binNil)
+		}
+		e.uvarint(binMap, uint64(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key(), depth+1); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		var fields []int
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				fields = append(fields, i)
+			}
+		}
+		e.uvarint(binMap, uint64(len(fields)))
+		for _, i := range fields {
+			e.uvarint(binString, uint64(len(t.Field(i).Name)))
+			e.w.WriteString(t.Field(i).Name)
+			if err := e.encode(v.Field(i), depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type binDecoder struct {
+	r binReader
+}
+
+func (d *binDecoder) length() (int, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, err
+	}
+	if n > binMaxLength {
+		return 0, fmt.Errorf("%w: binary codec length %d too large", ErrUnsupportedFormat, n)
+	}
+	return int(n), nil
+}
+
+func (d *binDecoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *binDecoder) decode(depth int) (any, error) {
+	if depth > binMaxDepth {
+		return nil, fmt.Errorf("%w: binary codec value nested too deeply", ErrUnsupportedFormat)
+	}
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case binNil:
+		return nil, nil
+	case binFalse:
+		return false, nil
+	case binTrue:
+		return true, nil
+	case binInt, binInt8, binInt16, binInt32, binInt64:
+		x, err := binary.ReadVarint(d.r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case binInt:
+			return int(x), nil
+		case binInt8:
+			return int8(x), nil
+		case binInt16:
+			return int16(x), nil
+		case binInt32:
+			return int32(x), nil
+		}
+		return x, nil
+	case binUint, binUint8, binUint16, binUint32, binUint64:
+		x, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case binUint:
+			return uint(x), nil
+		case binUint8:
+			return uint8(x), nil
+		case binUint16:
+			return uint16(x), nil
+		case binUint32:
+			return uint32(x), nil
+		}
+		return x, nil
+	case binFloat32:
+		var b [4]byte
+		if _, err := io.ReadFull(d.r, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b[:])), nil
+	case binFloat64:
+		var b [8]byte
+		if _, err := io.ReadFull(d.r, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+	case binString:
+		b, err := d.bytes()
+		return string(b), err
+	case binBytes:
+		return d.bytes()
+	case binTime:
+		b, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case binArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		// Do not trust n for the allocation, the slice grows as values are
+		// actually decoded.
+		values := make([]any, 0, minInt(n, 1024))
+		for i := 0; i < n; i++ {
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case binMap:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[any]any, minInt(n, 1024))
+		for i := 0; i < n; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if !isComparable(key) {
+				return nil, fmt.Errorf("%w: binary codec map key of type %T is not comparable", ErrUnsupportedFormat, key)
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("%w: unknown binary codec type 0x%02x", ErrUnsupportedFormat, tag)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
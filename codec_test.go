@@ -0,0 +1,365 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Codec(t *testing.T) {
+	codecs := map[string]anystore.Codec{
+		"gob":    anystore.GobCodec,
+		"json":   anystore.JSONCodec,
+		"binary": anystore.BinaryCodec,
+	}
+	for name, codec := range codecs {
+		for _, appendOnly := range []bool{false, true} {
+			for _, gzip := range []bool{false, true} {
+				file := filepath.Join(t.TempDir(), name)
+				options := anystore.Options{
+					EnablePersistence:   true,
+					PersistenceFile:     file,
+					Codec:               codec,
+					AppendOnly:          appendOnly,
+					GZipPersistenceFile: gzip,
+				}
+				a, err := anystore.NewAnyStore(&options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Store("hello", "world"); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.StoreWithTTL("temporary", "value", time.Hour); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.StoreWithTTL("expired", "value", time.Nanosecond); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Store("deleted", true); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Delete("deleted"); err != nil {
+					t.Fatal(err)
+				}
+				// The codec is picked from the header, any codec reads the file.
+				for _, other := range codecs {
+					options.Codec = other
+					b, err := anystore.NewAnyStore(&options)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if v, err := b.Load("hello"); err != nil {
+						t.Fatalf("%s (append-only %v, gzip %v): %v", name, appendOnly, gzip, err)
+					} else if v != "world" {
+						t.Errorf("%s: expected world, got %v", name, v)
+					}
+					if v, err := b.Load("temporary"); err != nil {
+						t.Fatal(err)
+					} else if v != "value" {
+						t.Errorf("%s: expected value, got %v", name, v)
+					}
+					for _, key := range []string{"expired", "deleted"} {
+						if b.HasKey(key) {
+							t.Errorf("%s: expected %s to be gone", name, key)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAnyStore_JSONCodec(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "json")
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		Encryption:        anystore.EncryptionNone,
+		Codec:             anystore.JSONCodec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("number", 42); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`[{"key":"number","value":42}]`)) {
+		t.Errorf("expected readable JSON, got %q", data)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		Encryption:        anystore.EncryptionNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JSON numbers decode as float64.
+	if v, err := b.Load("number"); err != nil {
+		t.Fatal(err)
+	} else if v != float64(42) {
+		t.Errorf("expected float64(42), got %T %v", v, v)
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	now := time.Now()
+	values := map[any]any{
+		"string":  "value",
+		"int":     -1,
+		"int8":    int8(-8),
+		"int16":   int16(16),
+		"int32":   int32(-32),
+		"int64":   int64(1 << 40),
+		"uint":    uint(1),
+		"uint8":   uint8(8),
+		"uint16":  uint16(16),
+		"uint32":  uint32(32),
+		"uint64":  uint64(1 << 63),
+		"float32": float32(3.25),
+		"float64": 3.14159,
+		"bool":    true,
+		"nil":     nil,
+		"bytes":   []byte("bytes"),
+		"slice":   []any{"a", 1, false},
+		"map":     map[any]any{"nested": int64(2), 3: "three"},
+		"time":    now,
+		12:        "int key",
+	}
+	file := filepath.Join(t.TempDir(), "binary")
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		Codec:             anystore.BinaryCodec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StoreMany(values); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("struct", Component{ID: 1, Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range values {
+		v, err := b.Load(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tm, ok := v.(time.Time); ok {
+			if !tm.Equal(now) {
+				t.Errorf("expected %v, got %v", now, tm)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v, expected) {
+			t.Errorf("%v: expected %T %v, got %T %v", key, expected, expected, v, v)
+		}
+	}
+	// Structs decode as maps of their exported fields.
+	if v, err := b.Load("struct"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, map[any]any{"ID": 1, "Name": "one"}) {
+		t.Errorf("expected a map of the struct, got %#v", v)
+	}
+}
+
+func TestStash_Codec(t *testing.T) {
+	for _, codec := range []anystore.Codec{anystore.JSONCodec, anystore.BinaryCodec} {
+		file := filepath.Join(t.TempDir(), "stash")
+		thing := &Thing{
+			Name:        strptr("Codec"),
+			Description: "Stashed using a codec",
+			Number:      7,
+			Components:  []*Component{{ID: 1, Name: "one"}, {ID: 2, Name: "two"}},
+		}
+		if err := anystore.Stash(&anystore.StashConfig{
+			File:  file,
+			Key:   "thing",
+			Thing: thing,
+			Codec: codec,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Unstash picks the codec from the header.
+		var unstashed Thing
+		if err := anystore.Unstash(&anystore.StashConfig{
+			File:  file,
+			Key:   "thing",
+			Thing: &unstashed,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(thing, &unstashed) {
+			t.Errorf("expected %#v, got %#v", thing, &unstashed)
+		}
+		stash, err := anystore.NewStashReader(&anystore.StashConfig{
+			Key:   "thing",
+			Thing: thing,
+			Codec: codec,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed Thing
+		if err := anystore.Unstash(&anystore.StashConfig{
+			Reader: stash,
+			Key:    "thing",
+			Thing:  &streamed,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(thing, &streamed) {
+			t.Errorf("expected %#v, got %#v", thing, &streamed)
+		}
+	}
+}
+
+// customCodec is a Codec with an ID not known to the package.
+type customCodec struct{}
+
+func (customCodec) ID() byte { return 200 }
+
+func (customCodec) Encode(w io.Writer, v any) error {
+	return anystore.JSONCodec.Encode(w, v)
+}
+
+func (customCodec) Decode(r io.Reader, v any) error {
+	return anystore.JSONCodec.Decode(r, v)
+}
+
+func TestAnyStore_CustomCodec(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "custom")
+	options := anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		Codec:             customCodec{},
+	}
+	a, err := anystore.NewAnyStore(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	options.Codec = nil
+	c, err := anystore.NewAnyStore(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load("hello"); !errors.Is(err, anystore.ErrUnknownCodec) {
+		t.Errorf("expected ErrUnknownCodec, got %v", err)
+	}
+}
+
+func TestAnyStore_CodecKeyType(t *testing.T) {
+	type structKey struct{ A int }
+	for _, codec := range []anystore.Codec{anystore.JSONCodec, anystore.BinaryCodec} {
+		for _, appendOnly := range []bool{false, true} {
+			options := anystore.Options{
+				EnablePersistence: true,
+				PersistenceFile:   filepath.Join(t.TempDir(), "keys"),
+				Codec:             codec,
+				AppendOnly:        appendOnly,
+			}
+			a, err := anystore.NewAnyStore(&options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Store("hello", "world"); err != nil {
+				t.Fatal(err)
+			}
+			type namedKey string
+			for _, key := range []any{structKey{1}, [2]int{1, 2}, new(int), namedKey("named"), time.Unix(1, 0)} {
+				if err := a.Store(key, "x"); !errors.Is(err, anystore.ErrCodecKeyType) {
+					t.Errorf("%T: expected ErrCodecKeyType, got %v", key, err)
+				}
+			}
+			if a.HasKey(structKey{1}) {
+				t.Error("expected the rejected key not to be stored")
+			}
+			// The file is still readable by a fresh store.
+			b, err := anystore.NewAnyStore(&options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, err := b.Load("hello"); err != nil {
+				t.Fatal(err)
+			} else if v != "world" {
+				t.Errorf("expected world, got %v", v)
+			}
+		}
+	}
+}
+
+func TestAnyStore_CodecKeyRoundTrip(t *testing.T) {
+	keys := map[string][]any{
+		"json": {"string", 1.5, true},
+		"binary": {
+			"string", true,
+			int(-1), int8(-8), int16(-16), int32(-32), int64(-64),
+			uint(1), uint8(8), uint16(16), uint32(32), uint64(64),
+			float32(3.25), 3.5,
+		},
+	}
+	codecs := map[string]anystore.Codec{"json": anystore.JSONCodec, "binary": anystore.BinaryCodec}
+	for name, codec := range codecs {
+		for _, appendOnly := range []bool{false, true} {
+			options := anystore.Options{
+				EnablePersistence: true,
+				PersistenceFile:   filepath.Join(t.TempDir(), name),
+				Codec:             codec,
+				AppendOnly:        appendOnly,
+			}
+			a, err := anystore.NewAnyStore(&options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range keys[name] {
+				if err := a.Store(key, i); err != nil {
+					t.Fatalf("%s: %T: %v", name, key, err)
+				}
+			}
+			// Every accepted key is found by a fresh store.
+			b, err := anystore.NewAnyStore(&options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys[name] {
+				if v, err := b.Load(key); err != nil {
+					t.Fatal(err)
+				} else if v == nil {
+					t.Errorf("%s (append-only %v): key %T %v not found", name, appendOnly, key, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package anystore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compression selects the algorithm compressing persisted data before it is
+// encrypted (see Options.Compression).
+type Compression string
+
+const (
+	CompressionNone  Compression = "none"
+	CompressionGzip  Compression = "gzip"
+	CompressionZlib  Compression = "zlib"
+	CompressionFlate Compression = "flate"
+)
+
+// Values of tagCompression, uncompressed data has no tagCompression field.
+const (
+	compressionGzip  byte = 1
+	compressionZlib  byte = 2
+	compressionFlate byte = 3
+)
+
+// gzipMagic starts gzip data. Data written before the compression was
+// recorded in the header is detected as gzipped by it (a GOB stream can not
+// start with these bytes).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// parseCompression returns the compression of Options (or StashConfig),
+// Compression if set, otherwise gzip if gzip is true or none. level must be a
+// level of compress/flate, 0 selects the default level.
+func parseCompression(c Compression, gzip bool, level int) (Compression, int, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return "", 0, fmt.Errorf("invalid compression level %d", level)
+	}
+	switch c {
+	case "":
+		if gzip {
+			return CompressionGzip, level, nil
+		}
+		return CompressionNone, level, nil
+	case CompressionNone, CompressionGzip, CompressionZlib, CompressionFlate:
+		return c, level, nil
+	}
+	return "", 0, fmt.Errorf("unknown compression %q", c)
+}
+
+// compressionHeader returns the header field recording compression c, none
+// for CompressionNone.
+func compressionHeader(c Compression) header {
+	var id byte
+	switch c {
+	case CompressionGzip:
+		id = compressionGzip
+	case CompressionZlib:
+		id = compressionZlib
+	case CompressionFlate:
+		id = compressionFlate
+	default:
+		return nil
+	}
+	return header{{tag: tagCompression, value: []byte{id}}}
+}
+
+// newCompressor returns a writer compressing into w using c at level. Close
+// must be called to flush the compressor, it does not close w.
+func newCompressor(c Compression, level int, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZlib:
+		return zlib.NewWriterLevel(w, level)
+	case CompressionFlate:
+		return flate.NewWriter(w, level)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// newDecompressor returns a reader decompressing r according to the
+// compression recorded in header h. If h records no compression, gzipped data
+// written before the compression was recorded is detected by its magic.
+func newDecompressor(h header, r *bufio.Reader) (io.Reader, error) {
+	value, ok := h.get(tagCompression)
+	if !ok {
+		if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+			return gzip.NewReader(r)
+		}
+		return r, nil
+	}
+	if len(value) != 1 {
+		return nil, fmt.Errorf("%w: invalid compression", ErrUnsupportedFormat)
+	}
+	switch value[0] {
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZlib:
+		return zlib.NewReader(r)
+	case compressionFlate:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("%w: unknown compression %d", ErrUnsupportedFormat, value[0])
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
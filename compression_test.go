@@ -0,0 +1,118 @@
+package anystore_test
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Compression(t *testing.T) {
+	compressions := []anystore.Compression{
+		anystore.CompressionNone,
+		anystore.CompressionGzip,
+		anystore.CompressionZlib,
+		anystore.CompressionFlate,
+	}
+	for _, compression := range compressions {
+		for _, appendOnly := range []bool{false, true} {
+			file := filepath.Join(t.TempDir(), string(compression))
+			a, err := anystore.NewAnyStore(&anystore.Options{
+				EnablePersistence: true,
+				PersistenceFile:   file,
+				Compression:       compression,
+				CompressionLevel:  9,
+				AppendOnly:        appendOnly,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Store("hello", "world"); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Store("number", 42); err != nil {
+				t.Fatal(err)
+			}
+			// Whatever the options of the reader, the compression is
+			// detected from the header.
+			for _, other := range compressions {
+				for _, gzip := range []bool{false, true} {
+					b, err := anystore.NewAnyStore(&anystore.Options{
+						EnablePersistence:   true,
+						PersistenceFile:     file,
+						Compression:         other,
+						GZipPersistenceFile: gzip,
+						AppendOnly:          appendOnly,
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if v, err := b.Load("hello"); err != nil {
+						t.Fatalf("%s read as %s (gzip %v): %v", compression, other, gzip, err)
+					} else if v != "world" {
+						t.Errorf("expected world, got %v", v)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAnyStore_CompressionOptions(t *testing.T) {
+	if _, err := anystore.NewAnyStore(&anystore.Options{Compression: "lzma"}); err == nil {
+		t.Error("expected error with an unknown compression")
+	}
+	if _, err := anystore.NewAnyStore(&anystore.Options{Compression: anystore.CompressionGzip, CompressionLevel: 10}); err == nil {
+		t.Error("expected error with an invalid compression level")
+	}
+}
+
+func TestAnyStore_LegacyGzip(t *testing.T) {
+	// Data gzipped before the compression was recorded in the header.
+	key := anystore.NewKey()
+	binkey, err := anystore.ToBinaryEncryptionKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := anystore.NewMemoryBackend()
+	if _, err := backend.Replace(legacyGzip(t, binkey, map[any]any{"hello": "world"})); err != nil {
+		t.Fatal(err)
+	}
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		Backend:           backend,
+		EncryptionKey:     key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+}
+
+// legacyGzip returns kv GOB-encoded, gzipped and encrypted without recording
+// the compression in the header.
+func legacyGzip(t *testing.T, key []byte, kv map[any]any) []byte {
+	t.Helper()
+	var buf anystore.BytesBufferWriteCloser
+	encrypted, err := anystore.NewEncryptWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipWriter := gzip.NewWriter(encrypted)
+	if err := gob.NewEncoder(gzipWriter).Encode(kv); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,110 @@
+package anystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+var (
+	ErrDefaultKeyInUse error = errors.New("the publicly known DefaultEncryptionKey is in use")
+)
+
+// strictMode is set by SetStrictMode.
+var strictMode atomic.Bool
+
+// SetStrictMode enables (or disables) strict mode for all stores, stashes and
+// key rotations in the process. In strict mode, using the publicly known
+// DefaultEncryptionKey (no key given or the default key given explicitly) is
+// an error (ErrDefaultKeyInUse) as if Options.RequireExplicitKey (or
+// StashConfig.RequireExplicitKey) was set. Strict mode is checked when a key
+// is set, stores already using the default key are not affected.
+func SetStrictMode(strict bool) {
+	strictMode.Store(strict)
+}
+
+// StrictMode returns true if strict mode is enabled (see SetStrictMode).
+func StrictMode() bool {
+	return strictMode.Load()
+}
+
+// requireExplicitKey returns true if the default key is refused by the store.
+func (a *anyStore) requireExplicitKey() bool {
+	return a.explicitKey.Load() || strictMode.Load()
+}
+
+// decodeExplicitKey decodes key (see decodeKey) and returns
+// ErrDefaultKeyInUse if it is the DefaultEncryptionKey and the store requires
+// an explicit key.
+func (a *anyStore) decodeExplicitKey(key string) (rawKey, error) {
+	binkey, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if a.requireExplicitKey() && isDefaultKey(binkey) {
+		return nil, ErrDefaultKeyInUse
+	}
+	return binkey, nil
+}
+
+// isDefaultKey returns true if key is the DefaultEncryptionKey.
+func isDefaultKey(key []byte) bool {
+	defaultKey, err := base64.RawStdEncoding.DecodeString(DefaultEncryptionKey)
+	return err == nil && bytes.Equal(key, defaultKey)
+}
+
+// UsesDefaultKey returns true if the persistence (or stash) file was written
+// using the publicly known DefaultEncryptionKey, for auditing existing
+// deployments. Only the start of the file is decrypted (the first chunk or,
+// for an append-only log, the first record), neither the gzip setting nor any
+// other key is needed. Returns false if the file does not exist, is empty, is
+// not encrypted (EncryptionNone) or is encrypted using another key,
+// passphrase, key provider or recipients. file can start with tilde for HOME
+// resolution.
+func UsesDefaultKey(file string) (bool, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if isLog(data) {
+		data = data[logHeaderSize:]
+		if len(data) < frameHeaderSize {
+			return false, nil
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if len(data) < frameHeaderSize+size {
+			return false, fmt.Errorf("%w: truncated record", ErrCorruptLog)
+		}
+		data = data[frameHeaderSize : frameHeaderSize+size]
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+	defaultKey, err := decodeKey(DefaultEncryptionKey)
+	if err != nil {
+		return false, err
+	}
+	if _, _, err := newDecryptReader(defaultKey, bytes.NewReader(data)); err != nil {
+		switch {
+		case isAuthError(err),
+			errors.Is(err, ErrNotEncrypted),
+			errors.Is(err, ErrPassphraseRequired),
+			errors.Is(err, ErrKeyProviderRequired),
+			errors.Is(err, ErrIdentityRequired):
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
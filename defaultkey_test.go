@@ -0,0 +1,108 @@
+package anystore_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_RequireExplicitKey(t *testing.T) {
+	if _, err := anystore.NewAnyStore(&anystore.Options{
+		RequireExplicitKey: true,
+	}); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse without a key, got %v", err)
+	}
+	if _, err := anystore.NewAnyStore(&anystore.Options{
+		RequireExplicitKey: true,
+		EncryptionKey:      anystore.DefaultEncryptionKey,
+	}); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse with the default key, got %v", err)
+	}
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		RequireExplicitKey: true,
+		EncryptionKey:      anystore.NewKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SetEncryptionKey(anystore.DefaultEncryptionKey); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse from SetEncryptionKey, got %v", err)
+	}
+	if err := a.Rekey(anystore.NewKey(), anystore.DefaultEncryptionKey); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse from Rekey, got %v", err)
+	}
+	var thing Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		File:               filepath.Join(t.TempDir(), "stash"),
+		RequireExplicitKey: true,
+		Key:                "thing",
+		Thing:              &thing,
+	}); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse from Unstash, got %v", err)
+	}
+}
+
+func TestSetStrictMode(t *testing.T) {
+	anystore.SetStrictMode(true)
+	defer anystore.SetStrictMode(false)
+	if !anystore.StrictMode() {
+		t.Error("expected strict mode")
+	}
+	if _, err := anystore.NewAnyStore(&anystore.Options{}); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse, got %v", err)
+	}
+	thing := &Thing{Name: strptr("Strict")}
+	if err := anystore.Stash(&anystore.StashConfig{
+		File:  filepath.Join(t.TempDir(), "stash"),
+		Key:   "thing",
+		Thing: thing,
+	}); !errors.Is(err, anystore.ErrDefaultKeyInUse) {
+		t.Errorf("expected ErrDefaultKeyInUse from Stash, got %v", err)
+	}
+	anystore.SetStrictMode(false)
+	if _, err := anystore.NewAnyStore(&anystore.Options{}); err != nil {
+		t.Errorf("expected the default key without strict mode, got %v", err)
+	}
+}
+
+func TestUsesDefaultKey(t *testing.T) {
+	dir := t.TempDir()
+	if uses, err := anystore.UsesDefaultKey(filepath.Join(dir, "missing")); err != nil || uses {
+		t.Errorf("expected false, nil for a missing file, got %v, %v", uses, err)
+	}
+	for _, appendOnly := range []bool{false, true} {
+		defaultFile := filepath.Join(dir, "default")
+		keyFile := filepath.Join(dir, "key")
+		if appendOnly {
+			defaultFile += ".log"
+			keyFile += ".log"
+		}
+		for file, key := range map[string]string{defaultFile: "", keyFile: anystore.NewKey()} {
+			a, err := anystore.NewAnyStore(&anystore.Options{
+				EnablePersistence:   true,
+				PersistenceFile:     file,
+				EncryptionKey:       key,
+				GZipPersistenceFile: true,
+				AppendOnly:          appendOnly,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Store("hello", "world"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if uses, err := anystore.UsesDefaultKey(defaultFile); err != nil {
+			t.Fatal(err)
+		} else if !uses {
+			t.Errorf("expected %s to use the default key", defaultFile)
+		}
+		if uses, err := anystore.UsesDefaultKey(keyFile); err != nil {
+			t.Fatal(err)
+		} else if uses {
+			t.Errorf("expected %s not to use the default key", keyFile)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -19,8 +20,9 @@ var (
 )
 
 var (
-	ErrNoEditorFound error = errors.New("no editor found")
-	ErrNotATerminal  error = errors.New("os.Stdin is not a terminal")
+	ErrNoEditorFound      error = errors.New("no editor found")
+	ErrNotATerminal       error = errors.New("os.Stdin is not a terminal")
+	ErrPassphraseMismatch error = errors.New("passphrases do not match")
 )
 
 // EditThing is an interactive variant of Stash, editing the Thing
@@ -35,11 +37,37 @@ var (
 //
 // Environment variable EDITOR is used as a json editor falling back
 // to conf.Editor and finally one of the DefaultEditors.
+//
+// If conf.PromptPassphrase is true, conf.Passphrase is empty, no other key
+// (Keyring, KeyProvider, Recipients or Identity) is set and conf.Encryption is
+// not EncryptionNone, EditThing prompts for the passphrase (twice if the stash
+// file does not exist yet) and sets conf.Passphrase before editing.
 func EditThing(conf *StashConfig) error {
 	if !IsUnixTerminal(os.Stdin) {
 		return ErrNotATerminal
 	}
 
+	if conf.PromptPassphrase && conf.Passphrase == "" && !conf.hasKey() && conf.Encryption != EncryptionNone {
+		passphrase, err := ReadPassphrase(os.Stdin, "Passphrase: ")
+		if err != nil {
+			return err
+		}
+		file, err := expandHome(conf.File)
+		if err != nil {
+			return err
+		}
+		if file == "" || !fileExists(file) {
+			repeated, err := ReadPassphrase(os.Stdin, "Repeat passphrase: ")
+			if err != nil {
+				return err
+			}
+			if repeated != passphrase {
+				return ErrPassphraseMismatch
+			}
+		}
+		conf.Passphrase = passphrase
+	}
+
 	executables := []string{}
 
 	envEditor := os.Getenv("EDITOR")
@@ -187,24 +215,73 @@ func tryExec(ctx context.Context, executables []string, arg ...string) error {
 	return ErrNoEditorFound
 }
 
+// ReadPassphrase writes prompt to os.Stderr and reads a line from terminal f
+// (usually os.Stdin) with echo turned off. The trailing newline is not
+// included. Returns ErrNotATerminal if f is not a terminal.
+func ReadPassphrase(f *os.File, prompt string) (string, error) {
+	var termios unixTermios
+	if err := ioctlTermios(f, tcgets, &termios); err != nil {
+		return "", ErrNotATerminal
+	}
+	noEcho := termios
+	noEcho.Lflag &^= syscall.ECHO
+	if err := ioctlTermios(f, tcsets, &noEcho); err != nil {
+		return "", err
+	}
+	defer ioctlTermios(f, tcsets, &termios)
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	// Read byte by byte, nothing after the newline should be consumed.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// unixTermios is the termios structure of TCGETS and TCSETS.
+type unixTermios struct {
+	Iflag  uint32
+	Oflag  uint32
+	Cflag  uint32
+	Lflag  uint32
+	Line   uint8
+	Cc     [19]uint8
+	Ispeed uint32
+	Ospeed uint32
+}
+
+const (
+	tcgets   = 0x5401
+	tcsets   = 0x5402
+	sysIoctl = 16
+)
+
+// ioctlTermios gets (tcgets) or sets (tcsets) the termios of terminal f.
+func ioctlTermios(f *os.File, req uintptr, value *unixTermios) error {
+	_, _, e1 := syscall.Syscall(sysIoctl, f.Fd(), req, uintptr(unsafe.Pointer(value)))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
 // IsUnixTerminal is constructed from terminal.IsTerminal() and is only
 // reproduced here in order not to import an external dependency.
 func IsUnixTerminal(f *os.File) bool {
-	type UnixTermios struct {
-		Iflag  uint32
-		Oflag  uint32
-		Cflag  uint32
-		Lflag  uint32
-		Line   uint8
-		Cc     [19]uint8
-		Ispeed uint32
-		Ospeed uint32
-	}
-	const TCGETS = 0x5401
-	const SYS_IOCTL = 16
-	fd := f.Fd()
-	var value UnixTermios
-	req := TCGETS
-	_, _, e1 := syscall.Syscall(SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(&value)))
-	return e1 == 0
+	var value unixTermios
+	return ioctlTermios(f, tcgets, &value) == nil
 }
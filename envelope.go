@@ -0,0 +1,199 @@
+package anystore
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dataKeySize is the size of the random data key used with a KeyProvider.
+const dataKeySize int = 32
+
+// maxUnwrappedKeys is the number of unwrapped data keys remembered by an
+// envelopeKey.
+const maxUnwrappedKeys int = 16
+
+var (
+	ErrKeyProviderRequired error = errors.New("data is encrypted using a wrapped data key, but no key provider was given")
+)
+
+// KeyProvider wraps (encrypts) and unwraps (decrypts) data keys using a key
+// encryption key that never leaves the provider, for example a KMS or HSM.
+// With envelope encryption (see Options.KeyProvider) data is encrypted using a
+// random data key and the wrapped data key is stored in the header of the
+// encrypted data. See NewFileKeyProvider for a local reference
+// implementation.
+type KeyProvider interface {
+	// WrapKey encrypts dataKey, the returned wrapped key is stored as is in the
+	// header of the encrypted data.
+	WrapKey(dataKey []byte) (wrapped []byte, err error)
+	// UnwrapKey decrypts a wrapped key previously returned by WrapKey.
+	UnwrapKey(wrapped []byte) (dataKey []byte, err error)
+}
+
+// envelopeKey is a keySource using a random data key wrapped by a
+// KeyProvider. As calling the provider can be slow (or cost money), the data
+// key is generated and wrapped once and unwrapped data keys are remembered by
+// their wrapped key. New data is encrypted using the data key last seen
+// (generated or read), unwrapping only once per persistence file.
+type envelopeKey struct {
+	provider KeyProvider
+
+	mutex     sync.Mutex
+	current   *unwrappedKey
+	unwrapped map[string]*unwrappedKey
+}
+
+type unwrappedKey struct {
+	wrapped []byte
+	key     Secret
+}
+
+// newEnvelopeKey returns a keySource using data keys wrapped by provider.
+func newEnvelopeKey(provider KeyProvider) *envelopeKey {
+	return &envelopeKey{
+		provider:  provider,
+		unwrapped: make(map[string]*unwrappedKey),
+	}
+}
+
+func (k *envelopeKey) sealKey() ([]byte, header, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.current == nil {
+		dataKey := make([]byte, dataKeySize)
+		if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+			return nil, nil, err
+		}
+		wrapped, err := k.provider.WrapKey(dataKey)
+		if err != nil {
+			wipe(dataKey)
+			return nil, nil, fmt.Errorf("unable to wrap data key: %w", err)
+		}
+		k.current = k.remember(wrapped, dataKey)
+		wipe(dataKey)
+	}
+	return k.current.key, header{{tag: tagWrappedKey, value: k.current.wrapped}}, nil
+}
+
+func (k *envelopeKey) openKeys(h header) ([][]byte, error) {
+	wrapped, ok := h.get(tagWrappedKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: data is not encrypted using a wrapped data key", ErrUnsupportedFormat)
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	u, ok := k.unwrapped[string(wrapped)]
+	if !ok {
+		dataKey, err := k.provider.UnwrapKey(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key: %w", err)
+		}
+		switch len(dataKey) {
+		case 16, 24, 32:
+		default:
+			wipe(dataKey)
+			return nil, ErrKeyLength
+		}
+		u = k.remember(wrapped, dataKey)
+		wipe(dataKey)
+	}
+	// Keep using the data key of the persistence file for new data.
+	k.current = u
+	return [][]byte{u.key}, nil
+}
+
+func (k *envelopeKey) bytes() []byte {
+	key, _, err := k.sealKey()
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+func (k *envelopeKey) wipe() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, u := range k.unwrapped {
+		u.key.Wipe()
+	}
+	k.current = nil
+	k.unwrapped = make(map[string]*unwrappedKey)
+}
+
+// remember caches a copy of the unwrapped dataKey of wrapped, caller must hold
+// k.mutex.
+func (k *envelopeKey) remember(wrapped, dataKey []byte) *unwrappedKey {
+	u := &unwrappedKey{
+		wrapped: append([]byte(nil), wrapped...),
+		key:     append([]byte(nil), dataKey...),
+	}
+	if len(k.unwrapped) >= maxUnwrappedKeys {
+		for _, old := range k.unwrapped {
+			if old != k.current {
+				old.key.Wipe()
+			}
+		}
+		k.unwrapped = make(map[string]*unwrappedKey)
+	}
+	k.unwrapped[string(wrapped)] = u
+	return u
+}
+
+// fileKeyProvider is a KeyProvider wrapping data keys using Encrypt with a
+// key encryption key read from a file.
+type fileKeyProvider struct {
+	kek rawKey
+}
+
+// NewFileKeyProvider returns a KeyProvider using a 16, 24 or 32 byte
+// base64-encoded key encryption key (see NewKey) stored in file. If file does
+// not exist, a new key is generated and written to it (mode 0600). Data keys
+// are wrapped using Encrypt and unwrapped using Decrypt with the key
+// encryption key. The provider is intended as a reference implementation and
+// for offline use (development and tests), the key file should be kept apart
+// from the persistence file.
+func NewFileKeyProvider(file string) (KeyProvider, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		data = []byte(NewKey())
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	kek, err := decodeKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", file, err)
+	}
+	return &fileKeyProvider{kek: kek}, nil
+}
+
+func (p *fileKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return encrypt(p.kek, dataKey)
+}
+
+func (p *fileKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return decrypt(p.kek, wrapped)
+}
@@ -0,0 +1,160 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+// countingKeyProvider counts calls to the wrapped KeyProvider.
+type countingKeyProvider struct {
+	anystore.KeyProvider
+	wraps, unwraps int
+}
+
+func (p *countingKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	p.wraps++
+	return p.KeyProvider.WrapKey(dataKey)
+}
+
+func (p *countingKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	p.unwraps++
+	return p.KeyProvider.UnwrapKey(wrapped)
+}
+
+func TestNewFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "keys", "kek")
+	p, err := anystore.NewFileKeyProvider(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyfile); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := p.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Error("expected data key to be encrypted")
+	}
+	// The existing key file is reused.
+	again, err := anystore.NewFileKeyProvider(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped, err := again.UnwrapKey(wrapped); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("expected %q, got %q", dataKey, unwrapped)
+	}
+	other, err := anystore.NewFileKeyProvider(filepath.Join(dir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.UnwrapKey(wrapped); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "invalid"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anystore.NewFileKeyProvider(filepath.Join(dir, "invalid")); err == nil {
+		t.Error("expected error with an invalid key file")
+	}
+}
+
+func TestAnyStore_KeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	tempfile := filepath.Join(dir, "store")
+	fp, err := anystore.NewFileKeyProvider(filepath.Join(dir, "kek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &countingKeyProvider{KeyProvider: fp}
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		KeyProvider:       provider,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := a.Store("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.wraps != 1 {
+		t.Errorf("expected the data key to be wrapped once, got %d", provider.wraps)
+	}
+	reader := &countingKeyProvider{KeyProvider: fp}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		KeyProvider:       reader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := b.Load("counter"); err != nil {
+			t.Fatal(err)
+		} else if v != 4 {
+			t.Errorf("expected 4, got %v", v)
+		}
+		if err := b.Store("other", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The data key of the persistence file is reused for writes.
+	if reader.unwraps != 1 || reader.wraps != 0 {
+		t.Errorf("expected 1 unwrap and 0 wraps, got %d and %d", reader.unwraps, reader.wraps)
+	}
+	raw, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     anystore.NewKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Load("counter"); !errors.Is(err, anystore.ErrKeyProviderRequired) {
+		t.Errorf("expected ErrKeyProviderRequired, got %v", err)
+	}
+}
+
+func TestStash_KeyProvider(t *testing.T) {
+	provider, err := anystore.NewFileKeyProvider(filepath.Join(t.TempDir(), "kek"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thing := &Thing{Name: strptr("Envelope"), Number: 42}
+	reader, err := anystore.NewStashReader(&anystore.StashConfig{
+		KeyProvider: provider,
+		Key:         "thing",
+		Thing:       thing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		Reader:      reader,
+		KeyProvider: provider,
+		Key:         "thing",
+		Thing:       &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name == nil || *got.Name != *thing.Name || got.Number != thing.Number {
+		t.Errorf("expected %v, got %v", thing, got)
+	}
+}
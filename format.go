@@ -0,0 +1,180 @@
+package anystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encrypted data produced by Encrypt starts with a header followed by the
+// AES-GCM sealed data (ciphertext and tag):
+//
+//	magic   4 bytes "ANYE"
+//	version 1 byte
+//	length  2 bytes big-endian length of the header fields
+//	fields  tag (1 byte), length (2 bytes big-endian) and value of each field
+//	sealed  AES-GCM ciphertext and 16 byte tag
+//	mac     HMAC-SHA256 of everything above (only if tagKDF is present and
+//	        the data is not streamed)
+//
+// The entire header (magic to the last field) is passed to AES-GCM as
+// associated data and is therefore authenticated. If the header has a tagKDF
+// field, independent encryption and authentication subkeys are derived from
+// the key (see kdf.go) and the output is also authenticated with the
+// authentication subkey, binding the data to the key. Streamed data (with a
+// tagChunkSize field instead of a nonce, see NewEncryptWriter) is a sequence
+// of AES-GCM sealed chunks without a mac, only the encryption subkey is
+// derived and the chunks are authenticated by AES-GCM alone. Unknown fields
+// make the data undecryptable (ErrUnsupportedFormat) rather than being
+// silently ignored. Data not starting with the magic is the legacy AES-CFB
+// with HMAC-SHA256 format (see Decrypt).
+var formatMagic = []byte("ANYE")
+
+const (
+	formatVersion    byte = 1
+	formatPrefixSize int  = 4 + 1 + 2
+)
+
+// Header field tags.
+const (
+	tagCipher byte = 1
+	tagNonce  byte = 2
+	tagKDF    byte = 3
+	tagSalt   byte = 4
+	// Salt and iteration count (uint32 big-endian) of a master key derived
+	// from a passphrase using PBKDF2-SHA256.
+	tagPBKDF2Salt       byte = 5
+	tagPBKDF2Iterations byte = 6
+	// ID of the master key in a Keyring.
+	tagKeyID byte = 7
+	// Data key wrapped by a KeyProvider.
+	tagWrappedKey byte = 8
+	// Ephemeral X25519 public key and, once per recipient, the recipient's
+	// X25519 public key followed by the wrapped file key.
+	tagEphemeralKey byte = 9
+	tagRecipient    byte = 10
+	// Plaintext size (uint32 big-endian) of each chunk of streamed data (see
+	// NewEncryptWriter).
+	tagChunkSize byte = 11
+	// SHA-256 checksum of unencrypted data (see EncryptionNone).
+	tagChecksum byte = 12
+	// ID of the Codec of the data, GobCodec if absent.
+	tagCodec byte = 13
+	// Compression of the data (see Compression), uncompressed if absent.
+	tagCompression byte = 14
+)
+
+// Values of tagCipher.
+const (
+	// Data is not encrypted (see EncryptionNone).
+	cipherNone   byte = 0
+	cipherAESGCM byte = 1
+)
+
+var (
+	ErrUnsupportedFormat    error = errors.New("unsupported encryption format")
+	ErrAuthenticationFailed error = errors.New("authentication failed (corrupt data or wrong encryption key)")
+)
+
+type headerField struct {
+	tag   byte
+	value []byte
+}
+
+// header is the list of fields of the encrypted data format.
+type header []headerField
+
+// get returns the value of the field tagged tag.
+func (h header) get(tag byte) ([]byte, bool) {
+	for _, f := range h {
+		if f.tag == tag {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+// getAll returns the values of all fields tagged tag.
+func (h header) getAll(tag byte) [][]byte {
+	var values [][]byte
+	for _, f := range h {
+		if f.tag == tag {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// marshal returns the complete header including magic, version and length.
+func (h header) marshal() []byte {
+	size := 0
+	for _, f := range h {
+		size += 3 + len(f.value)
+	}
+	buf := make([]byte, 0, formatPrefixSize+size)
+	buf = append(buf, formatMagic...)
+	buf = append(buf, formatVersion)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+	for _, f := range h {
+		buf = append(buf, f.tag)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.value)))
+		buf = append(buf, f.value...)
+	}
+	return buf
+}
+
+// checkHeader returns ErrUnsupportedFormat if h has unknown fields or an
+// unknown cipher and ErrNotEncrypted if the data is not encrypted.
+func checkHeader(h header) error {
+	if c, ok := h.get(tagCipher); ok && len(c) == 1 && c[0] == cipherNone {
+		return ErrNotEncrypted
+	}
+	for _, f := range h {
+		switch f.tag {
+		case tagCipher, tagNonce, tagKDF, tagSalt, tagPBKDF2Salt, tagPBKDF2Iterations,
+			tagKeyID, tagWrappedKey, tagEphemeralKey, tagRecipient, tagChunkSize, tagCodec, tagCompression:
+		default:
+			return fmt.Errorf("%w: unknown header field %d", ErrUnsupportedFormat, f.tag)
+		}
+	}
+	if c, ok := h.get(tagCipher); !ok || len(c) != 1 || c[0] != cipherAESGCM {
+		return fmt.Errorf("%w: unknown cipher", ErrUnsupportedFormat)
+	}
+	return nil
+}
+
+// isFormatted returns true if data starts with the magic of the encrypted
+// data format.
+func isFormatted(data []byte) bool {
+	return len(data) >= formatPrefixSize && bytes.Equal(data[:len(formatMagic)], formatMagic)
+}
+
+// parseHeader parses the header of data. Returns the header fields, the raw
+// header (the associated data) and the rest of data following the header.
+func parseHeader(data []byte) (h header, raw []byte, rest []byte, err error) {
+	if !isFormatted(data) {
+		return nil, nil, nil, ErrUnsupportedFormat
+	}
+	if version := data[len(formatMagic)]; version != formatVersion {
+		return nil, nil, nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, version)
+	}
+	size := int(binary.BigEndian.Uint16(data[len(formatMagic)+1:]))
+	if len(data) < formatPrefixSize+size {
+		return nil, nil, nil, fmt.Errorf("%w: truncated header", ErrUnsupportedFormat)
+	}
+	raw = data[:formatPrefixSize+size]
+	fields := raw[formatPrefixSize:]
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, nil, nil, fmt.Errorf("%w: truncated header field", ErrUnsupportedFormat)
+		}
+		length := int(binary.BigEndian.Uint16(fields[1:]))
+		if len(fields) < 3+length {
+			return nil, nil, nil, fmt.Errorf("%w: truncated header field", ErrUnsupportedFormat)
+		}
+		h = append(h, headerField{tag: fields[0], value: fields[3 : 3+length]})
+		fields = fields[3+length:]
+	}
+	return h, raw, data[len(raw):], nil
+}
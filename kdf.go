@@ -0,0 +1,87 @@
+package anystore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Values of tagKDF, the derivation of the keys actually used from the key
+// given to Encrypt and Decrypt (the master key). Data without tagKDF uses the
+// master key as is for AES-GCM.
+const (
+	kdfHKDFSHA256 byte = 1
+)
+
+const (
+	// saltSize is the size of the random salt used with HKDF.
+	saltSize int = 32
+	// subkeySize is the size of each derived subkey (AES-256 and
+	// HMAC-SHA256).
+	subkeySize int = 32
+)
+
+// HKDF info strings separating the derived subkeys.
+var (
+	hkdfInfoEncryption     = []byte("anystore encryption key")
+	hkdfInfoAuthentication = []byte("anystore authentication key")
+)
+
+// hkdf implements HKDF (RFC 5869) with SHA-256, returning length bytes of
+// output key material derived from secret, salt and info.
+func hkdf(secret, salt, info []byte, length int) []byte {
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+	var okm, t []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expander := hmac.New(sha256.New, prk)
+		expander.Write(t)
+		expander.Write(info)
+		expander.Write([]byte{counter})
+		t = expander.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:length]
+}
+
+// deriveKeys derives independent encryption (AES-256-GCM) and authentication
+// (HMAC-SHA256) subkeys from the master key and salt using HKDF-SHA256.
+func deriveKeys(master, salt []byte) (encryptionKey, authenticationKey []byte) {
+	encryptionKey = hkdf(master, salt, hkdfInfoEncryption, subkeySize)
+	authenticationKey = hkdf(master, salt, hkdfInfoAuthentication, subkeySize)
+	return encryptionKey, authenticationKey
+}
+
+// deriveEncryptionKey derives only the encryption (AES-256-GCM) subkey of
+// deriveKeys, for streamed data which has no HMAC.
+func deriveEncryptionKey(master, salt []byte) []byte {
+	return hkdf(master, salt, hkdfInfoEncryption, subkeySize)
+}
+
+// pbkdf2 implements PBKDF2 (RFC 8018) with HMAC-SHA256 as the pseudorandom
+// function, returning a key of length bytes derived from password and salt.
+func pbkdf2(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (length + hashLen - 1) / hashLen
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:length]
+}
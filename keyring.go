@@ -0,0 +1,184 @@
+package anystore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// maxKeyIDLength is the longest key ID accepted by a Keyring, the ID is
+// recorded in the header of every encrypted message.
+const maxKeyIDLength int = 255
+
+var (
+	ErrUnknownKeyID  error = errors.New("data is encrypted using a key not in the keyring")
+	ErrInvalidKeyID  error = fmt.Errorf("key ID must be 1 to %d bytes long", maxKeyIDLength)
+	ErrNoPrimaryKey  error = errors.New("keyring has no primary key")
+	ErrPrimaryKeyID  error = errors.New("can not remove the primary key from the keyring")
+	ErrKeyIDNotFound error = errors.New("key ID not found in keyring")
+)
+
+// Keyring holds several named master keys, one of which is the primary key.
+// Data is always encrypted using the primary key and the ID of the key is
+// recorded in the header, allowing data encrypted using any key in the ring to
+// be decrypted. Data without a key ID (written using a single EncryptionKey or
+// in the legacy format) is decrypted by trying the primary key first, then the
+// rest of the keys. A Keyring is safe for concurrent use and can be shared
+// between several stores (see Options.Keyring).
+//
+// A typical key rotation adds the new key to the ring of every instance and
+// makes it primary once all instances can decrypt with it. Once the
+// persistence file has been rewritten using the new primary key (any write,
+// or Compact in AppendOnly mode), the old key can be removed.
+type Keyring struct {
+	mutex   sync.RWMutex
+	keys    map[string]rawKey
+	primary string
+}
+
+// NewKeyring returns an empty Keyring, use Add to add keys.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[string]rawKey),
+	}
+}
+
+// Add adds (or replaces) a 16, 24 or 32 byte base64-encoded key (see NewKey)
+// under id. The first key added becomes the primary key.
+func (k *Keyring) Add(id string, key string) error {
+	if id == "" || len(id) > maxKeyIDLength {
+		return ErrInvalidKeyID
+	}
+	binkey, err := decodeKey(key)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[id] = binkey
+	if k.primary == "" {
+		k.primary = id
+	}
+	return nil
+}
+
+// SetPrimary makes the key with id the primary key used to encrypt new data.
+func (k *Keyring) SetPrimary(id string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: %q", ErrKeyIDNotFound, id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Primary returns the ID of the primary key or an empty string if the ring
+// is empty.
+func (k *Keyring) Primary() string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.primary
+}
+
+// Remove removes the key with id from the ring. The primary key can not be
+// removed, make another key primary first.
+func (k *Keyring) Remove(id string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrKeyIDNotFound, id)
+	}
+	if id == k.primary {
+		return ErrPrimaryKeyID
+	}
+	key.wipe()
+	delete(k.keys, id)
+	return nil
+}
+
+// IDs returns the sorted IDs of all keys in the ring.
+func (k *Keyring) IDs() []string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encrypt encrypts data using the primary key (see the package-level
+// Encrypt), recording the key ID in the header.
+func (k *Keyring) Encrypt(data []byte) ([]byte, error) {
+	return encrypt(k, data)
+}
+
+// Decrypt decrypts data using the key recorded in the header (see the
+// package-level Decrypt). Returns ErrUnknownKeyID if the key is not in the
+// ring.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	return decrypt(k, data)
+}
+
+func (k *Keyring) sealKey() ([]byte, header, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, ok := k.keys[k.primary]
+	if !ok {
+		return nil, nil, ErrNoPrimaryKey
+	}
+	return key, header{{tag: tagKeyID, value: []byte(k.primary)}}, nil
+}
+
+func (k *Keyring) openKeys(h header) ([][]byte, error) {
+	if err := checkMasterKey(h); err != nil {
+		return nil, err
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if id, ok := h.get(tagKeyID); ok {
+		key, ok := k.keys[string(id)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownKeyID, id)
+		}
+		return [][]byte{key}, nil
+	}
+	if len(k.keys) == 0 {
+		return nil, ErrNoPrimaryKey
+	}
+	candidates := make([][]byte, 0, len(k.keys))
+	if key, ok := k.keys[k.primary]; ok {
+		candidates = append(candidates, key)
+	}
+	for id, key := range k.keys {
+		if id != k.primary {
+			candidates = append(candidates, key)
+		}
+	}
+	return candidates, nil
+}
+
+// Wipe zeroes and removes all keys from the ring.
+func (k *Keyring) Wipe() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, key := range k.keys {
+		key.wipe()
+	}
+	k.keys = make(map[string]rawKey)
+	k.primary = ""
+}
+
+// wipe does nothing, the Keyring is owned by the caller and can be shared by
+// several stores (see Keyring.Wipe).
+func (k *Keyring) wipe() {}
+
+func (k *Keyring) bytes() []byte {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.keys[k.primary]
+}
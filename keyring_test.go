@@ -0,0 +1,158 @@
+package anystore_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey := anystore.NewKey()
+	newKey := anystore.NewKey()
+	ring := anystore.NewKeyring()
+	if err := ring.Add("", oldKey); !errors.Is(err, anystore.ErrInvalidKeyID) {
+		t.Errorf("expected ErrInvalidKeyID, got %v", err)
+	}
+	if err := ring.Add("old", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Add("new", newKey); err != nil {
+		t.Fatal(err)
+	}
+	if p := ring.Primary(); p != "old" {
+		t.Errorf("expected first key to be primary, got %q", p)
+	}
+	written, err := ring.Encrypt([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(written, []byte("old")) {
+		t.Error("expected key ID in header")
+	}
+	if err := ring.SetPrimary("missing"); !errors.Is(err, anystore.ErrKeyIDNotFound) {
+		t.Errorf("expected ErrKeyIDNotFound, got %v", err)
+	}
+	if err := ring.SetPrimary("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Remove("new"); !errors.Is(err, anystore.ErrPrimaryKeyID) {
+		t.Errorf("expected ErrPrimaryKeyID, got %v", err)
+	}
+	// Data written with a non-primary key is still readable.
+	if data, err := ring.Decrypt(written); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello world" {
+		t.Errorf("expected hello world, got %q", data)
+	}
+	// Data without a key ID is tried with every key.
+	binOldKey, err := base64.RawStdEncoding.DecodeString(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := anystore.Encrypt(binOldKey, []byte("single key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ring.Decrypt(single); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "single key" {
+		t.Errorf("expected single key, got %q", data)
+	}
+	legacy := legacyEncrypt(t, binOldKey, []byte("legacy"))
+	if data, err := ring.Decrypt(legacy); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "legacy" {
+		t.Errorf("expected legacy, got %q", data)
+	}
+	// A raw key ignores the key ID.
+	if data, err := anystore.Decrypt(binOldKey, written); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello world" {
+		t.Errorf("expected hello world, got %q", data)
+	}
+	if err := ring.Remove("old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.Decrypt(written); !errors.Is(err, anystore.ErrUnknownKeyID) {
+		t.Errorf("expected ErrUnknownKeyID, got %v", err)
+	}
+	if ids := ring.IDs(); len(ids) != 1 || ids[0] != "new" {
+		t.Errorf("expected [new], got %v", ids)
+	}
+	if _, err := anystore.NewKeyring().Encrypt([]byte("x")); !errors.Is(err, anystore.ErrNoPrimaryKey) {
+		t.Errorf("expected ErrNoPrimaryKey, got %v", err)
+	}
+}
+
+func TestAnyStore_Keyring(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-keyring-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	oldKey := anystore.NewKey()
+	newKey := anystore.NewKey()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     oldKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	ring := anystore.NewKeyring()
+	if err := ring.Add("2024", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Add("2025", newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.SetPrimary("2025"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		Keyring:           ring,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	// Writes use the primary key.
+	if err := b.Store("hello", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Load("hello"); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed with the old key, got %v", err)
+	}
+	c, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     newKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "again" {
+		t.Errorf("expected again, got %v", v)
+	}
+}
@@ -0,0 +1,118 @@
+package anystore
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrPassphraseRequired error = errors.New("data is encrypted using a passphrase, but no passphrase was given")
+)
+
+// keySource provides the master key to Encrypt and Decrypt data with (see
+// encrypt and decrypt). The master key can be given as is or be derived from
+// parameters recorded in the header of the encrypted data.
+type keySource interface {
+	// sealKey returns the master key to encrypt new data with and any header
+	// fields needed to recover the master key with openKey.
+	sealKey() (key []byte, fields header, err error)
+	// openKeys returns the candidate master keys to decrypt data with header
+	// h, in the order they should be tried.
+	openKeys(h header) ([][]byte, error)
+	// bytes returns the current master key (see
+	// AnyStore.GetEncryptionKeyBytes).
+	bytes() []byte
+	// wipe zeroes the key material owned by the keySource (see
+	// AnyStore.Wipe).
+	wipe()
+}
+
+// keyRef is stored in anyStore.key as atomic.Value requires all stored values
+// to be of the same concrete type.
+type keyRef struct {
+	keySource
+}
+
+// keys returns the keySource of the store.
+func (a *anyStore) keys() (keySource, error) {
+	ref, ok := a.key.Load().(keyRef)
+	if !ok || ref.keySource == nil {
+		return nil, errors.New("encryption key not set")
+	}
+	return ref.keySource, nil
+}
+
+// borrowedKeys is a keySource owned by another store (e.g the origin of a
+// transaction), wipe is a no-op as the key material is not ours to zero.
+type borrowedKeys struct {
+	keySource
+}
+
+func (borrowedKeys) wipe() {}
+
+// setKeys replaces the keySource of the store.
+func (a *anyStore) setKeys(k keySource) {
+	a.key.Store(keyRef{k})
+	a.invalidateCache()
+}
+
+// decodeKey decodes a 16, 24 or 32 byte base64-encoded key.
+func decodeKey(key string) (rawKey, error) {
+	binkey, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	switch len(binkey) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrKeyLength
+	}
+	return binkey, nil
+}
+
+// checkMasterKey returns an error if data with header h is not encrypted
+// using a master key given as is (rawKey or Keyring).
+func checkMasterKey(h header) error {
+	if _, ok := h.get(tagPBKDF2Salt); ok {
+		return ErrPassphraseRequired
+	}
+	if _, ok := h.get(tagWrappedKey); ok {
+		return ErrKeyProviderRequired
+	}
+	if _, ok := h.get(tagEphemeralKey); ok {
+		return ErrIdentityRequired
+	}
+	return nil
+}
+
+// rawKey is a 16, 24 or 32 byte long master key used as is.
+type rawKey []byte
+
+func (k rawKey) sealKey() ([]byte, header, error) {
+	return k, nil, nil
+}
+
+func (k rawKey) openKeys(h header) ([][]byte, error) {
+	if err := checkMasterKey(h); err != nil {
+		return nil, err
+	}
+	return [][]byte{k}, nil
+}
+
+func (k rawKey) bytes() []byte {
+	return k
+}
+
+func (k rawKey) wipe() {
+	wipe(k)
+}
+
+// String returns a redacted placeholder (see Secret).
+func (k rawKey) String() string {
+	return Secret(k).String()
+}
+
+// GoString returns a redacted placeholder (see Secret).
+func (k rawKey) GoString() string {
+	return Secret(k).GoString()
+}
@@ -0,0 +1,285 @@
+package anystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// DefaultCompactThreshold is the number of records appended to an append-only
+// log before it is automatically compacted when Options.CompactThreshold is
+// omitted.
+const DefaultCompactThreshold int = 1000
+
+var (
+	ErrCorruptLog error = errors.New("corrupt append-only log")
+)
+
+// An append-only log starts with logMagic followed by a random log ID
+// (changed on every compaction) and a sequence of frames. Each frame is a
+// 4 byte big-endian length followed by an encrypted and authenticated
+// logRecord (e.g GOB, optionally compressed, see marshal). The first record holds a
+// snapshot of the entire map, subsequent records hold changes. Every record
+// carries the log ID, a record can therefore not be replayed onto another log.
+var logMagic = []byte("ANYSLOG\x01")
+
+const (
+	logIDSize       int = 16
+	logHeaderSize   int = 8 + logIDSize
+	frameHeaderSize int = 4
+)
+
+// logState describes the log last decoded (or written) by this instance. end
+// is the offset right after the last valid frame, anything beyond it is a torn
+// write from a crashed writer (or a record currently being written). records
+// is the number of change records since the snapshot.
+type logState struct {
+	id      [logIDSize]byte
+	end     int64
+	records int
+}
+
+// logRecord is either the snapshot (first record) or a change record of the
+// log identified by Log.
+type logRecord struct {
+	Log      [logIDSize]byte
+	Snapshot anyMap
+	Ops      []logOp
+}
+
+type logOp struct {
+	Key    any
+	Value  any
+	Delete bool
+}
+
+func (a *anyStore) Compact() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.compact()
+}
+
+func (u *unsafeAnyStore) Compact() error {
+	return u.compact()
+}
+
+// compact is the non-locking implementation of Compact.
+func (a *anyStore) compact() error {
+	if !a.persist.Load() {
+		return nil
+	}
+	backend, err := a.storage()
+	if err != nil {
+		return err
+	}
+	if err := backend.Lock(); err != nil {
+		return err
+	}
+	defer backend.Unlock()
+	state, err := a.readState(backend)
+	if err != nil {
+		return err
+	}
+	kvN := state.kv.clone()
+	kvN.purge(time.Now().UnixNano())
+	if a.appendOnly.Load() {
+		err = a.compactLog(backend, kvN)
+	} else {
+		err = a.save(backend, kvN)
+	}
+	if err != nil {
+		return err
+	}
+	a.setKV(kvN)
+	return nil
+}
+
+// isLog returns true if data is an append-only log.
+func isLog(data []byte) bool {
+	return len(data) >= logHeaderSize && bytes.Equal(data[:len(logMagic)], logMagic)
+}
+
+// replayLog decodes an entire append-only log.
+func (a *anyStore) replayLog(data []byte) (*persistenceCache, error) {
+	state := &persistenceCache{
+		kv:  make(anyMap),
+		log: &logState{},
+	}
+	copy(state.log.id[:], data[len(logMagic):logHeaderSize])
+	end, records, err := a.replayFrames(state.kv, state.log.id, data[logHeaderSize:], true)
+	if err != nil {
+		return nil, err
+	}
+	state.log.end = int64(logHeaderSize) + end
+	state.log.records = records
+	return state, nil
+}
+
+// replayAppended replays records appended to the log since c was decoded.
+// The ok result is false if nothing could be replayed, e.g the log has been
+// replaced by a compaction or a non-log save (the records belong to another
+// log), and the entire content has to be decoded.
+func (a *anyStore) replayAppended(backend AppendBackend, c *persistenceCache) (state *persistenceCache, ok bool) {
+	appended, version, err := backend.ReadFrom(c.log.end)
+	if err != nil || len(appended) == 0 {
+		return nil, false
+	}
+	kv := c.kv.clone()
+	end, records, err := a.replayFrames(kv, c.log.id, appended, false)
+	if err != nil || records == 0 {
+		return nil, false
+	}
+	state = &persistenceCache{
+		version: version,
+		kv:      kv,
+		log: &logState{
+			id:      c.log.id,
+			end:     c.log.end + end,
+			records: c.log.records + records,
+		},
+	}
+	a.setCache(state)
+	return state, true
+}
+
+// replayFrames applies the records of log id in data to kv and returns the
+// offset after the last valid frame and the number of change records
+// replayed. A truncated final frame or a final frame failing authentication
+// (a torn write) is ignored unless it is the first frame of the log.
+func (a *anyStore) replayFrames(kv anyMap, id [logIDSize]byte, data []byte, first bool) (end int64, records int, err error) {
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < frameHeaderSize {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(data[offset:]))
+		if size == 0 || size > int64(len(data)-offset-frameHeaderSize) {
+			break
+		}
+		next := offset + frameHeaderSize + int(size)
+		var record logRecord
+		if err := a.unmarshal(data[offset+frameHeaderSize:next], &record); err != nil {
+			if next == len(data) && !first && isAuthError(err) {
+				break
+			}
+			return 0, 0, fmt.Errorf("%w: record at offset %d: %w", ErrCorruptLog, offset, err)
+		}
+		if record.Log != id {
+			return 0, 0, fmt.Errorf("%w: record at offset %d belongs to another log", ErrCorruptLog, offset)
+		}
+		if first {
+			for k, v := range record.Snapshot {
+				kv[k] = v
+			}
+		} else {
+			for _, op := range record.Ops {
+				if op.Delete {
+					delete(kv, op.Key)
+				} else {
+					kv[op.Key] = op.Value
+				}
+			}
+			records++
+		}
+		first = false
+		offset = next
+	}
+	return int64(offset), records, nil
+}
+
+// appendLog appends the changes from state.kv to kvN as a new record to the
+// log. If the content is not a log (or missing), the backend does not
+// implement AppendBackend or the number of records exceeds the compaction
+// threshold, the log is compacted instead. Caller must hold the lock of the
+// backend.
+func (a *anyStore) appendLog(backend Backend, state *persistenceCache, kvN anyMap) error {
+	ops := logDiff(state.kv, kvN)
+	if len(ops) == 0 {
+		return nil
+	}
+	threshold := int(a.compactThreshold.Load())
+	if threshold == 0 {
+		threshold = DefaultCompactThreshold
+	}
+	ab, ok := backend.(AppendBackend)
+	if !ok || state.log == nil || (threshold > 0 && state.log.records >= threshold) {
+		return a.compactLog(backend, kvN)
+	}
+	payload, err := a.marshal(logRecord{Log: state.log.id, Ops: ops})
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	// Append truncates any torn write left behind by a crashed writer.
+	version, err := ab.Append(state.log.end, frame)
+	if err != nil {
+		return err
+	}
+	a.setCache(&persistenceCache{
+		version: version,
+		kv:      kvN,
+		log: &logState{
+			id:      state.log.id,
+			end:     state.log.end + int64(len(frame)),
+			records: state.log.records + 1,
+		},
+	})
+	return nil
+}
+
+// compactLog replaces the content of the backend with a new log (new log ID)
+// holding a single snapshot of kv. Caller must hold the lock of the backend.
+func (a *anyStore) compactLog(backend Backend, kv anyMap) error {
+	state := &persistenceCache{
+		kv:  kv,
+		log: &logState{},
+	}
+	if _, err := rand.Read(state.log.id[:]); err != nil {
+		return err
+	}
+	payload, err := a.marshal(logRecord{Log: state.log.id, Snapshot: kv})
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, logHeaderSize+frameHeaderSize+len(payload))
+	data = append(data, logMagic...)
+	data = append(data, state.log.id[:]...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+	data = append(data, payload...)
+	version, err := backend.Replace(data)
+	if err != nil {
+		return err
+	}
+	state.version = version
+	state.log.end = int64(len(data))
+	a.setCache(state)
+	return nil
+}
+
+// isAuthError returns true if err is an authentication failure from Decrypt.
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrAuthenticationFailed) || errors.Is(err, ErrHMACValidationFailed) || errors.Is(err, ErrChecksumMismatch)
+}
+
+// logDiff returns the operations turning kvO into kvN.
+func logDiff(kvO, kvN anyMap) []logOp {
+	var ops []logOp
+	for k, v := range kvN {
+		if old, ok := kvO[k]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		ops = append(ops, logOp{Key: k, Value: v})
+	}
+	for k := range kvO {
+		if _, ok := kvN[k]; !ok {
+			ops = append(ops, logOp{Key: k, Delete: true})
+		}
+	}
+	return ops
+}
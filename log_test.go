@@ -0,0 +1,200 @@
+package anystore_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func fileSize(t *testing.T, file string) int64 {
+	t.Helper()
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestAnyStore_AppendOnly(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	options := &anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     anystore.NewKey(),
+		AppendOnly:        true,
+	}
+	a, err := anystore.NewAnyStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	size := fileSize(t, tempfile)
+	for i := 0; i < 10; i++ {
+		if err := a.Store("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if s := fileSize(t, tempfile); s <= size {
+		t.Errorf("expected log to grow from %d bytes, got %d", size, s)
+	}
+	if v, err := b.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 9 {
+		t.Errorf("expected 9, got %v", v)
+	}
+	if a.HasKey("hello") {
+		t.Error("expected hello to be deleted")
+	}
+
+	// Simulate a torn write by a crashed writer.
+	f, err = os.OpenFile(tempfile, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 64, 'x', 'y', 'z'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	torn := fileSize(t, tempfile)
+	if v, err := b.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 9 {
+		t.Errorf("expected 9 after torn write, got %v", v)
+	}
+	if err := a.Store("after", "crash"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("after"); err != nil {
+		t.Fatal(err)
+	} else if v != "crash" {
+		t.Errorf("expected crash, got %v", v)
+	}
+
+	// A store not in append-only mode reads the log as well.
+	c, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     options.EncryptionKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := c.Keys(); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %v", keys)
+	}
+
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s := fileSize(t, tempfile); s >= torn {
+		t.Errorf("expected compacted log to be smaller than %d bytes, got %d", torn, s)
+	}
+	if v, err := a.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 9 {
+		t.Errorf("expected 9 after compaction, got %v", v)
+	}
+	if err := a.Store("counter", 10); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 10 {
+		t.Errorf("expected 10, got %v", v)
+	}
+}
+
+func TestAnyStore_AppendOnly_compactThreshold(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     anystore.NewKey(),
+		AppendOnly:        true,
+		CompactThreshold:  5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 1000)
+	var largest int64
+	for i := 0; i < 50; i++ {
+		if err := a.Store("key", value+string(rune('a'+i%26))); err != nil {
+			t.Fatal(err)
+		}
+		if s := fileSize(t, tempfile); s > largest {
+			largest = s
+		}
+	}
+	// Snapshot plus at most 5 records of roughly 1kB each.
+	if largest > 10000 {
+		t.Errorf("expected log to be compacted, largest size was %d bytes", largest)
+	}
+	if v, err := a.Load("key"); err != nil {
+		t.Fatal(err)
+	} else if v != value+string(rune('a'+49%26)) {
+		t.Error("unexpected value after compaction")
+	}
+}
+
+func BenchmarkStoreAndLoadAppendOnly(b *testing.B) {
+	f, err := os.CreateTemp("", "anystore-benchmark-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		AppendOnly:        true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if err := a.Store(i%100, i); err != nil {
+			b.Fatal(err)
+		}
+		if v, err := a.Load(i % 100); err != nil {
+			b.Fatal(err)
+		} else if v != i {
+			b.Fatal("value does not match")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package anystore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultPassphraseIterations is the number of PBKDF2-SHA256 iterations used
+// to derive the master key from a passphrase when
+// Options.PassphraseIterations (or StashConfig.PassphraseIterations) is
+// omitted.
+const DefaultPassphraseIterations int = 600000
+
+// maxPassphraseIterations limits the iteration count accepted from a header,
+// protecting against data making the key derivation take forever.
+const maxPassphraseIterations int = 1 << 26
+
+// maxDerivedKeys is the number of derived keys remembered by a passphraseKey.
+const maxDerivedKeys int = 16
+
+var (
+	ErrEmptyPassphrase error = errors.New("passphrase can not be empty")
+)
+
+// passphraseKey derives the master key from a passphrase using PBKDF2-SHA256
+// with a random salt and an iteration count recorded in the header of the
+// encrypted data. As the derivation is slow by design, derived keys are
+// remembered by salt and iteration count and new data is encrypted using the
+// salt last seen (generated or read), deriving the key only once per
+// persistence file.
+type passphraseKey struct {
+	passphrase Secret
+	iterations int
+
+	mutex   sync.Mutex
+	current *derivedKey
+	derived map[string]*derivedKey
+}
+
+type derivedKey struct {
+	salt       []byte
+	iterations int
+	key        Secret
+}
+
+// newPassphraseKey returns a keySource deriving the master key from
+// passphrase. An iterations value of zero or less uses
+// DefaultPassphraseIterations.
+func newPassphraseKey(passphrase string, iterations int) (*passphraseKey, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	if iterations <= 0 {
+		iterations = DefaultPassphraseIterations
+	}
+	if iterations > maxPassphraseIterations {
+		return nil, fmt.Errorf("passphrase iterations can not exceed %d", maxPassphraseIterations)
+	}
+	return &passphraseKey{
+		passphrase: []byte(passphrase),
+		iterations: iterations,
+		derived:    make(map[string]*derivedKey),
+	}, nil
+}
+
+func (k *passphraseKey) sealKey() ([]byte, header, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.current == nil || k.current.iterations != k.iterations {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+		k.current = k.derive(salt, k.iterations)
+	}
+	iterations := binary.BigEndian.AppendUint32(nil, uint32(k.current.iterations))
+	return k.current.key, header{
+		{tag: tagPBKDF2Salt, value: k.current.salt},
+		{tag: tagPBKDF2Iterations, value: iterations},
+	}, nil
+}
+
+func (k *passphraseKey) openKeys(h header) ([][]byte, error) {
+	salt, ok := h.get(tagPBKDF2Salt)
+	if !ok {
+		return nil, fmt.Errorf("%w: data is not encrypted using a passphrase", ErrUnsupportedFormat)
+	}
+	value, ok := h.get(tagPBKDF2Iterations)
+	if !ok || len(value) != 4 {
+		return nil, fmt.Errorf("%w: invalid passphrase iterations", ErrUnsupportedFormat)
+	}
+	iterations := int(binary.BigEndian.Uint32(value))
+	if iterations < 1 || iterations > maxPassphraseIterations {
+		return nil, fmt.Errorf("%w: invalid passphrase iterations", ErrUnsupportedFormat)
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	d := k.derive(salt, iterations)
+	if iterations == k.iterations {
+		// Keep using the salt of the persistence file for new data.
+		k.current = d
+	}
+	return [][]byte{d.key}, nil
+}
+
+func (k *passphraseKey) bytes() []byte {
+	key, _, err := k.sealKey()
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+func (k *passphraseKey) wipe() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.passphrase.Wipe()
+	for _, d := range k.derived {
+		d.key.Wipe()
+	}
+	k.current = nil
+	k.derived = make(map[string]*derivedKey)
+}
+
+// derive returns the key derived from the passphrase, salt and iterations,
+// caller must hold k.mutex.
+func (k *passphraseKey) derive(salt []byte, iterations int) *derivedKey {
+	id := string(binary.BigEndian.AppendUint32(nil, uint32(iterations))) + string(salt)
+	if d, ok := k.derived[id]; ok {
+		return d
+	}
+	d := &derivedKey{
+		salt:       append([]byte(nil), salt...),
+		iterations: iterations,
+		key:        pbkdf2(k.passphrase, salt, iterations, subkeySize),
+	}
+	if len(k.derived) >= maxDerivedKeys {
+		for _, old := range k.derived {
+			if old != k.current {
+				old.key.Wipe()
+			}
+		}
+		k.derived = make(map[string]*derivedKey)
+	}
+	k.derived[id] = d
+	return d
+}
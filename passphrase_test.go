@@ -0,0 +1,117 @@
+package anystore_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Passphrase(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-passphrase-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence:    true,
+		PersistenceFile:      tempfile,
+		Passphrase:           "correct horse battery staple",
+		PassphraseIterations: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	// Iteration count is read from the persistence file.
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence:    true,
+		PersistenceFile:      tempfile,
+		Passphrase:           "correct horse battery staple",
+		PassphraseIterations: 2000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	if err := b.Store("hello", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "again" {
+		t.Errorf("expected again, got %v", v)
+	}
+	wrong, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence:    true,
+		PersistenceFile:      tempfile,
+		Passphrase:           "wrong horse battery staple",
+		PassphraseIterations: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Load("hello"); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
+	key, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     anystore.NewKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Load("hello"); !errors.Is(err, anystore.ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+}
+
+func TestStash_passphrase(t *testing.T) {
+	thing := &Thing{Name: strptr("Passphrase"), Number: 42}
+	reader, err := anystore.NewStashReader(&anystore.StashConfig{
+		Passphrase:           "secret",
+		PassphraseIterations: 1000,
+		Key:                  "thing",
+		Thing:                thing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		Reader:     reader,
+		Passphrase: "secret",
+		Key:        "thing",
+		Thing:      &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name == nil || *got.Name != *thing.Name || got.Number != thing.Number {
+		t.Errorf("expected %v, got %v", thing, got)
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := anystore.ReadPassphrase(r, "Passphrase: "); !errors.Is(err, anystore.ErrNotATerminal) {
+		t.Errorf("expected ErrNotATerminal, got %v", err)
+	}
+}
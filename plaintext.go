@@ -0,0 +1,130 @@
+package anystore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Encryption selects whether persisted data is encrypted (see
+// Options.Encryption).
+type Encryption string
+
+const (
+	// EncryptionAESGCM encrypts persisted data using AES-GCM (see Encrypt),
+	// the default.
+	EncryptionAESGCM Encryption = "aes-gcm"
+	// EncryptionNone writes persisted data unencrypted after a header marking
+	// it as such and holding a SHA-256 checksum of the data. Intended for
+	// local development and test fixtures, the data is not protected in any
+	// way.
+	EncryptionNone Encryption = "none"
+)
+
+var (
+	ErrNotEncrypted     error = errors.New("data is not encrypted (written with Encryption none), refusing to load it using an encryption key")
+	ErrEncrypted        error = errors.New("data is encrypted, but Encryption is none (an encryption key is required)")
+	ErrChecksumMismatch error = errors.New("SHA-256 checksum mismatch (corrupt data)")
+
+	ErrKeyWithEncryptionNone error = errors.New("an encryption key (or passphrase) can not be used with Encryption none")
+)
+
+// parseEncryption returns true if e is EncryptionNone, false if e is
+// EncryptionAESGCM (or empty).
+func parseEncryption(e Encryption) (plaintext bool, err error) {
+	switch e {
+	case "", EncryptionAESGCM:
+		return false, nil
+	case EncryptionNone:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown encryption %q", e)
+	}
+}
+
+// writePlain writes what encode writes to w unencrypted, preceded by a header
+// with cipherNone, the SHA-256 checksum of the data and fields. As the checksum
+// is in the header, the data is buffered in memory.
+//
+//	b = bytes
+//	["ANYE"][version_1_b][header_length_2_b][header_fields][data]
+func writePlain(w io.Writer, fields header, encode func(w io.Writer) error) error {
+	var data bytes.Buffer
+	if err := encode(&data); err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(data.Bytes())
+	h := header{
+		{tag: tagCipher, value: []byte{cipherNone}},
+		{tag: tagChecksum, value: checksum[:]},
+	}
+	h = append(h, fields...)
+	for _, p := range [][]byte{h.marshal(), data.Bytes()} {
+		if n, err := w.Write(p); err != nil {
+			return err
+		} else if n != len(p) {
+			return ErrWroteTooLittle
+		}
+	}
+	return nil
+}
+
+// newPlainReader returns a reader of the data written by writePlain to r and
+// its header, the reader returns ErrChecksumMismatch instead of io.EOF if the
+// checksum does not match. Encrypted data returns ErrEncrypted.
+func newPlainReader(r io.Reader) (io.Reader, header, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(formatPrefixSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !isFormatted(prefix) {
+		return nil, nil, fmt.Errorf("%w (legacy format)", ErrEncrypted)
+	}
+	size := int(binary.BigEndian.Uint16(prefix[len(formatMagic)+1:]))
+	raw := make([]byte, formatPrefixSize+size)
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return nil, nil, fmt.Errorf("%w: truncated header", ErrUnsupportedFormat)
+	}
+	h, _, _, err := parseHeader(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c, ok := h.get(tagCipher); !ok || len(c) != 1 || c[0] != cipherNone {
+		return nil, nil, ErrEncrypted
+	}
+	checksum, ok := h.get(tagChecksum)
+	if !ok || len(checksum) != sha256.Size {
+		return nil, nil, fmt.Errorf("%w: missing checksum", ErrUnsupportedFormat)
+	}
+	for _, f := range h {
+		switch f.tag {
+		case tagCipher, tagChecksum, tagCodec, tagCompression:
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown header field %d", ErrUnsupportedFormat, f.tag)
+		}
+	}
+	return &checksumReader{r: br, hash: sha256.New(), checksum: checksum}, h, nil
+}
+
+// checksumReader verifies the SHA-256 checksum of everything read from r at
+// end of file.
+type checksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	checksum []byte
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(c.hash.Sum(nil), c.checksum) {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,154 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_EncryptionNone(t *testing.T) {
+	dir := t.TempDir()
+	tempfile := filepath.Join(dir, "plain")
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		Encryption:        anystore.EncryptionNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "plaintext world"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(tempfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("ANYE")) || !bytes.Contains(data, []byte("plaintext world")) {
+		t.Error("expected a header followed by unencrypted data")
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		Encryption:        anystore.EncryptionNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "plaintext world" {
+		t.Errorf("expected plaintext world, got %v", v)
+	}
+	keyed, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyed.Load("hello"); !errors.Is(err, anystore.ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+	// Corruption is detected by the checksum.
+	corrupt := bytes.Replace(data, []byte("plaintext world"), []byte("plaintext w0rld"), 1)
+	if err := os.WriteFile(tempfile, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Load("hello"); !errors.Is(err, anystore.ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	encrypted := filepath.Join(dir, "encrypted")
+	if err := keyed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyed.SetPersistenceFile(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyed.Store("hello", "secret world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetPersistenceFile(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Load("hello"); !errors.Is(err, anystore.ErrEncrypted) {
+		t.Errorf("expected ErrEncrypted, got %v", err)
+	}
+
+	if _, err := anystore.NewAnyStore(&anystore.Options{
+		Encryption:    anystore.EncryptionNone,
+		EncryptionKey: anystore.NewKey(),
+	}); !errors.Is(err, anystore.ErrKeyWithEncryptionNone) {
+		t.Errorf("expected ErrKeyWithEncryptionNone, got %v", err)
+	}
+	if _, err := anystore.NewAnyStore(&anystore.Options{Encryption: "rot13"}); err == nil {
+		t.Error("expected error with unknown encryption")
+	}
+}
+
+func TestAnyStore_EncryptionNone_appendOnly(t *testing.T) {
+	tempfile := filepath.Join(t.TempDir(), "plain.log")
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		Encryption:        anystore.EncryptionNone,
+		AppendOnly:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := a.Store("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		Encryption:        anystore.EncryptionNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 9 {
+		t.Errorf("expected 9, got %v", v)
+	}
+}
+
+func TestStash_EncryptionNone(t *testing.T) {
+	thing := &Thing{Name: strptr("Plain"), Number: 42}
+	reader, err := anystore.NewStashReader(&anystore.StashConfig{
+		Encryption: anystore.EncryptionNone,
+		Key:        "thing",
+		Thing:      thing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		Reader:     bytes.NewReader(reader.Bytes()),
+		Encryption: anystore.EncryptionNone,
+		Key:        "thing",
+		Thing:      &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name == nil || *got.Name != *thing.Name || got.Number != thing.Number {
+		t.Errorf("expected %v, got %v", thing, got)
+	}
+	if err := anystore.Unstash(&anystore.StashConfig{
+		Reader: bytes.NewReader(reader.Bytes()),
+		Key:    "thing",
+		Thing:  &got,
+	}); !errors.Is(err, anystore.ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+}
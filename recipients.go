@@ -0,0 +1,206 @@
+package anystore
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// fileKeySize is the size of the random file key encrypted to each
+	// recipient.
+	fileKeySize int = 32
+	// x25519KeySize is the size of X25519 public and private keys.
+	x25519KeySize int = 32
+	// maxRecipients limits the number of recipients so that the header does
+	// not overflow (each recipient adds 83 bytes).
+	maxRecipients int = 512
+)
+
+// HKDF info string of the key wrapping the file key for a recipient.
+var hkdfInfoRecipient = []byte("anystore recipient key")
+
+var (
+	ErrIdentityRequired  error = errors.New("data is encrypted to recipients, but no identity was given")
+	ErrNotARecipient     error = errors.New("data is not encrypted to this identity")
+	ErrTooManyRecipients error = fmt.Errorf("too many recipients (max %d)", maxRecipients)
+)
+
+// NewKeyPair generates a X25519 key pair for use with StashConfig.Identity
+// and StashConfig.Recipients, returned base64-encoded (see ParseIdentity and
+// ParseRecipient). Get a new key pair from the command line:
+//
+//	go run github.com/sa6mwa/anystore/cmd/newkey -keypair
+func NewKeyPair() (identity string, recipient string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	identity = base64.RawStdEncoding.EncodeToString(key.Bytes())
+	recipient = base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes())
+	return identity, recipient, nil
+}
+
+// ParseIdentity parses a base64-encoded X25519 private key (see NewKeyPair).
+func ParseIdentity(identity string) (*ecdh.PrivateKey, error) {
+	binkey, err := base64.RawStdEncoding.DecodeString(identity)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(binkey)
+}
+
+// ParseRecipient parses a base64-encoded X25519 public key (see NewKeyPair).
+func ParseRecipient(recipient string) (*ecdh.PublicKey, error) {
+	binkey, err := base64.RawStdEncoding.DecodeString(recipient)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(binkey)
+}
+
+// recipientsKey is a keySource encrypting a random file key to one or more
+// X25519 public keys. An ephemeral key pair is generated for every message
+// and the file key is wrapped for each recipient using AES-256-GCM with a key
+// derived from the shared secret using HKDF-SHA256. The header records the
+// ephemeral public key and one field per recipient holding the recipient's
+// public key followed by the wrapped file key.
+//
+// If no recipients are given, data is encrypted to the recipients of the
+// data last decrypted using identity, or to identity itself.
+type recipientsKey struct {
+	recipients []*ecdh.PublicKey
+	identity   *ecdh.PrivateKey
+
+	mutex sync.Mutex
+	last  []*ecdh.PublicKey
+}
+
+// newRecipientsKey returns a keySource encrypting to recipients and
+// decrypting using identity, either can be omitted.
+func newRecipientsKey(recipients []*ecdh.PublicKey, identity *ecdh.PrivateKey) *recipientsKey {
+	return &recipientsKey{
+		recipients: recipients,
+		identity:   identity,
+	}
+}
+
+func (k *recipientsKey) sealKey() ([]byte, header, error) {
+	recipients := k.recipients
+	if len(recipients) == 0 {
+		k.mutex.Lock()
+		recipients = k.last
+		k.mutex.Unlock()
+	}
+	if len(recipients) == 0 && k.identity != nil {
+		recipients = []*ecdh.PublicKey{k.identity.PublicKey()}
+	}
+	if len(recipients) == 0 {
+		return nil, nil, errors.New("no recipients to encrypt to")
+	}
+	if len(recipients) > maxRecipients {
+		return nil, nil, ErrTooManyRecipients
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, nil, err
+	}
+	h := header{{tag: tagEphemeralKey, value: ephemeral.PublicKey().Bytes()}}
+	for _, recipient := range recipients {
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapKey := recipientWrapKey(shared, ephemeral.PublicKey(), recipient)
+		wipe(shared)
+		gcm, err := newGCM(wrapKey)
+		wipe(wrapKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The wrapping key is unique per ephemeral key and recipient, a zero
+		// nonce is never reused.
+		nonce := make([]byte, gcm.NonceSize())
+		stanza := append([]byte(nil), recipient.Bytes()...)
+		stanza = gcm.Seal(stanza, nonce, fileKey, nil)
+		h = append(h, headerField{tag: tagRecipient, value: stanza})
+	}
+	return fileKey, h, nil
+}
+
+func (k *recipientsKey) openKeys(h header) ([][]byte, error) {
+	value, ok := h.get(tagEphemeralKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: data is not encrypted to recipients", ErrUnsupportedFormat)
+	}
+	if k.identity == nil {
+		return nil, ErrIdentityRequired
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ephemeral key", ErrUnsupportedFormat)
+	}
+	self := k.identity.PublicKey()
+	var fileKey []byte
+	var recipients []*ecdh.PublicKey
+	for _, stanza := range h.getAll(tagRecipient) {
+		if len(stanza) != x25519KeySize+fileKeySize+16 {
+			return nil, fmt.Errorf("%w: invalid recipient", ErrUnsupportedFormat)
+		}
+		recipient, err := ecdh.X25519().NewPublicKey(stanza[:x25519KeySize])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid recipient", ErrUnsupportedFormat)
+		}
+		recipients = append(recipients, recipient)
+		if fileKey != nil || !bytes.Equal(stanza[:x25519KeySize], self.Bytes()) {
+			continue
+		}
+		shared, err := k.identity.ECDH(ephemeral)
+		if err != nil {
+			return nil, ErrAuthenticationFailed
+		}
+		wrapKey := recipientWrapKey(shared, ephemeral, self)
+		wipe(shared)
+		gcm, err := newGCM(wrapKey)
+		wipe(wrapKey)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err = gcm.Open(nil, make([]byte, gcm.NonceSize()), stanza[x25519KeySize:], nil)
+		if err != nil {
+			return nil, ErrAuthenticationFailed
+		}
+	}
+	if fileKey == nil {
+		return nil, ErrNotARecipient
+	}
+	// Keep encrypting to the same recipients when rewriting the data.
+	k.mutex.Lock()
+	k.last = recipients
+	k.mutex.Unlock()
+	return [][]byte{fileKey}, nil
+}
+
+func (k *recipientsKey) bytes() []byte {
+	return nil
+}
+
+// wipe does nothing as the identity (crypto/ecdh) can not be zeroed and file
+// keys are not kept.
+func (k *recipientsKey) wipe() {}
+
+// recipientWrapKey derives the AES-256 key wrapping the file key for
+// recipient from the X25519 shared secret.
+func recipientWrapKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) []byte {
+	salt := append(append([]byte(nil), ephemeral.Bytes()...), recipient.Bytes()...)
+	return hkdf(shared, salt, hkdfInfoRecipient, subkeySize)
+}
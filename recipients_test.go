@@ -0,0 +1,137 @@
+package anystore_test
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func newKeyPair(t *testing.T) (*ecdh.PrivateKey, *ecdh.PublicKey) {
+	t.Helper()
+	identity, recipient, err := anystore.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := anystore.ParseIdentity(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := anystore.ParseRecipient(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(priv.PublicKey()) {
+		t.Fatal("expected recipient to be the public key of identity")
+	}
+	return priv, pub
+}
+
+func TestStash_Recipients(t *testing.T) {
+	hostA, recipientA := newKeyPair(t)
+	hostB, recipientB := newKeyPair(t)
+	outsider, _ := newKeyPair(t)
+	file := filepath.Join(t.TempDir(), "stash")
+	thing := &Thing{Name: strptr("Recipients"), Number: 42}
+	if err := anystore.Stash(&anystore.StashConfig{
+		File:       file,
+		Recipients: []*ecdh.PublicKey{recipientA, recipientB},
+		Key:        "thing",
+		Thing:      thing,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []*ecdh.PrivateKey{hostA, hostB} {
+		var got Thing
+		if err := anystore.Unstash(&anystore.StashConfig{
+			File:     file,
+			Identity: identity,
+			Key:      "thing",
+			Thing:    &got,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name == nil || *got.Name != *thing.Name || got.Number != thing.Number {
+			t.Errorf("expected %v, got %v", thing, got)
+		}
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		File:     file,
+		Identity: outsider,
+		Key:      "thing",
+		Thing:    &got,
+	}); !errors.Is(err, anystore.ErrNotARecipient) {
+		t.Errorf("expected ErrNotARecipient, got %v", err)
+	}
+	if err := anystore.Unstash(&anystore.StashConfig{
+		File:          file,
+		EncryptionKey: anystore.NewKey(),
+		Key:           "thing",
+		Thing:         &got,
+	}); !errors.Is(err, anystore.ErrIdentityRequired) {
+		t.Errorf("expected ErrIdentityRequired, got %v", err)
+	}
+	// Rewriting with an identity keeps the recipients of the stash.
+	store, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		Identity:          hostA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := anystore.Unstash(&anystore.StashConfig{
+		File:     file,
+		Identity: hostB,
+		Key:      "thing",
+		Thing:    &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	if _, err := anystore.ParseRecipient("not base64!"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := anystore.ParseRecipient(anystore.NewKey()[:10]); err == nil {
+		t.Error("expected error with a short key")
+	}
+	if _, err := anystore.ParseIdentity("AAAA"); err == nil {
+		t.Error("expected error with a short key")
+	}
+}
+
+func TestStash_RecipientsTwice(t *testing.T) {
+	host, recipient := newKeyPair(t)
+	file := filepath.Join(t.TempDir(), "stash")
+	// A build machine only has the public key, yet stashes repeatedly.
+	for i := 1; i <= 2; i++ {
+		if err := anystore.Stash(&anystore.StashConfig{
+			File:       file,
+			Recipients: []*ecdh.PublicKey{recipient},
+			Key:        "thing",
+			Thing:      &Thing{Name: strptr("Recipients"), Number: i},
+		}); err != nil {
+			t.Fatalf("stash %d: %v", i, err)
+		}
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		File:     file,
+		Identity: host,
+		Key:      "thing",
+		Thing:    &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Number != 2 {
+		t.Errorf("expected the second stash, got %d", got.Number)
+	}
+}
@@ -0,0 +1,103 @@
+package anystore
+
+func (a *anyStore) Rekey(oldKey, newKey string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.rekey(oldKey, newKey)
+}
+
+func (u *unsafeAnyStore) Rekey(oldKey, newKey string) error {
+	return u.rekey(oldKey, newKey)
+}
+
+// rekey is the non-locking implementation of Rekey.
+func (a *anyStore) rekey(oldKey, newKey string) error {
+	if a.plaintext.Load() {
+		return ErrKeyWithEncryptionNone
+	}
+	oldKeys, err := decodeKey(oldKey)
+	if err != nil {
+		return err
+	}
+	newKeys, err := a.decodeExplicitKey(newKey)
+	if err != nil {
+		return err
+	}
+	if !a.persist.Load() {
+		a.setKeys(newKeys)
+		return nil
+	}
+	return a.reencrypt(oldKeys, newKeys)
+}
+
+// reencrypt re-encrypts the persistence file from oldKeys to newKeys and sets
+// newKeys as the keySource of the store. The content is read with oldKeys
+// (ignoring the cache) and written with newKeys in the same format (snapshot
+// or compacted append-only log) while holding the lock of the backend.
+func (a *anyStore) reencrypt(oldKeys, newKeys keySource) error {
+	backend, err := a.storage()
+	if err != nil {
+		return err
+	}
+	if err := backend.Lock(); err != nil {
+		return err
+	}
+	defer backend.Unlock()
+	state, err := a.withKeys(oldKeys).readState(backend)
+	if err != nil {
+		return err
+	}
+	rekeyed := a.withKeys(newKeys)
+	if state.version != "" {
+		if state.log != nil {
+			err = rekeyed.compactLog(backend, state.kv)
+		} else {
+			err = rekeyed.save(backend, state.kv)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	a.setKeys(newKeys)
+	if c := rekeyed.cached(); c != nil {
+		a.setCache(c)
+	}
+	a.setKV(state.kv)
+	return nil
+}
+
+// withKeys returns an ephemeral anyStore using keys to encrypt and decrypt,
+// but otherwise configured as a (codec, compression, TTL and append-only
+// settings). The
+// returned store has its own (empty) cache and no watchers.
+func (a *anyStore) withKeys(keys keySource) *anyStore {
+	s := a.newTransaction(make(anyMap))
+	s.persist.Store(a.persist.Load())
+	s.appendOnly.Store(a.appendOnly.Load())
+	s.compactThreshold.Store(a.compactThreshold.Load())
+	if backend, err := a.storage(); err == nil {
+		s.backend.Store(backendRef{backend})
+	}
+	s.key.Store(keyRef{keys})
+	return s
+}
+
+// RekeyFile re-encrypts the persistence file, encrypted with oldKey, using
+// newKey (see AnyStore.Rekey). Set gzip to true to gzip the re-encrypted file
+// (Options.GZipPersistenceFile), the file is read regardless of its
+// compression. Keys are 16, 24 or 32 byte base64-encoded strings.
+func RekeyFile(file string, oldKey, newKey string, gzip bool) error {
+	// The store is opened with newKey as oldKey may be the DefaultEncryptionKey
+	// refused in strict mode (see SetStrictMode).
+	a, err := newAnyStore(&Options{
+		EnablePersistence:   true,
+		PersistenceFile:     file,
+		GZipPersistenceFile: gzip,
+		EncryptionKey:       newKey,
+	})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.Rekey(oldKey, newKey)
+}
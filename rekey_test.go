@@ -0,0 +1,135 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Rekey(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-rekey-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	oldKey := anystore.NewKey()
+	newKey := anystore.NewKey()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence:   true,
+		PersistenceFile:     tempfile,
+		GZipPersistenceFile: true,
+		EncryptionKey:       oldKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence:   true,
+		PersistenceFile:     tempfile,
+		GZipPersistenceFile: true,
+		EncryptionKey:       oldKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	// A wrong old key leaves the file untouched.
+	if err := a.Rekey(anystore.NewKey(), newKey); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed, got %v", err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	if err := a.Rekey(oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world after Rekey, got %v", v)
+	}
+	if _, err := b.Load("hello"); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed with the old key, got %v", err)
+	}
+	if _, err := b.SetEncryptionKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world with the new key, got %v", v)
+	}
+}
+
+func TestRekeyFile(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-rekey-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	oldKey := anystore.NewKey()
+	newKey := anystore.NewKey()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     oldKey,
+		AppendOnly:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := a.Store("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := anystore.RekeyFile(tempfile, oldKey, newKey, false); err != nil {
+		t.Fatal(err)
+	}
+	// The log is replaced by a compacted log.
+	if data, err := os.ReadFile(tempfile); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(data, []byte("ANYSLOG")) {
+		t.Error("expected the persistence file to remain an append-only log")
+	}
+	// a still uses the old key.
+	if err := a.Store("counter", 10); err == nil {
+		t.Error("expected error storing with the old key")
+	}
+	if _, err := a.SetEncryptionKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("counter", 10); err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     newKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Load("counter"); err != nil {
+		t.Fatal(err)
+	} else if v != 10 {
+		t.Errorf("expected 10, got %v", v)
+	}
+}
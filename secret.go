@@ -0,0 +1,48 @@
+package anystore
+
+// Secret is a byte slice holding key material or other sensitive data. Its
+// String and GoString methods are redacted so that a Secret is never printed
+// or logged by accident (e.g using %v, %s or %#v), use Wipe to zero it once it
+// is no longer needed.
+type Secret []byte
+
+// String returns a redacted placeholder instead of the secret.
+func (s Secret) String() string {
+	return "[REDACTED]"
+}
+
+// GoString returns a redacted placeholder instead of the secret.
+func (s Secret) GoString() string {
+	return "anystore.Secret{REDACTED}"
+}
+
+// Wipe zeroes the secret.
+func (s Secret) Wipe() {
+	wipe(s)
+}
+
+// wipe zeroes b.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (a *anyStore) Wipe() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.wipe()
+}
+
+func (u *unsafeAnyStore) Wipe() {
+	u.wipe()
+}
+
+// wipe is the non-locking implementation of Wipe.
+func (a *anyStore) wipe() {
+	if keys, err := a.keys(); err == nil {
+		keys.wipe()
+	}
+	a.key.Store(keyRef{})
+	a.invalidateCache()
+}
@@ -0,0 +1,78 @@
+package anystore_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestSecret(t *testing.T) {
+	secret := anystore.Secret("my very secret key")
+	for _, format := range []string{"%v", "%s", "%#v", "%x", "%q"} {
+		if out := fmt.Sprintf(format, secret); strings.Contains(out, "secret key") || strings.Contains(out, fmt.Sprintf("%x", []byte("secret"))) {
+			t.Errorf("%s: expected redacted output, got %s", format, out)
+		}
+	}
+	secret.Wipe()
+	if !bytes.Equal(secret, make([]byte, len(secret))) {
+		t.Errorf("expected zeroed secret, got %v", []byte(secret))
+	}
+}
+
+func TestAnyStore_Wipe(t *testing.T) {
+	key := anystore.NewKey()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "wipe"),
+		EncryptionKey:     key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	// GetEncryptionKeyBytes returns a copy.
+	copied := a.GetEncryptionKeyBytes()
+	for i := range copied {
+		copied[i] = 0
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+	a.Wipe()
+	if k := a.GetEncryptionKeyBytes(); k != nil {
+		t.Errorf("expected no key after Wipe, got %v", k)
+	}
+	if _, err := a.Load("hello"); err == nil {
+		t.Error("expected error loading after Wipe")
+	}
+	if _, err := a.SetEncryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world after setting the key again, got %v", v)
+	}
+}
+
+func TestKeyring_Wipe(t *testing.T) {
+	ring := anystore.NewKeyring()
+	if err := ring.Add("one", anystore.NewKey()); err != nil {
+		t.Fatal(err)
+	}
+	ring.Wipe()
+	if ids := ring.IDs(); len(ids) != 0 {
+		t.Errorf("expected empty ring, got %v", ids)
+	}
+	if p := ring.Primary(); p != "" {
+		t.Errorf("expected no primary key, got %q", p)
+	}
+}
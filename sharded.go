@@ -0,0 +1,725 @@
+package anystore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShards is the number of shards of a new ShardedStore if none is
+	// given.
+	DefaultShards int = 8
+	// maxShards limits the number of shards (and open lockfiles).
+	maxShards int = 1024
+	// manifestVersion is the version of the manifest format.
+	manifestVersion int = 1
+)
+
+var (
+	ErrInvalidShardCount  error = fmt.Errorf("shard count must be between 1 and %d", maxShards)
+	ErrShardCountMismatch error = errors.New("shard count does not match the manifest (see Reshard)")
+	ErrShardedBackend     error = errors.New("a ShardedStore requires file persistence, Options.Backend can not be sharded")
+	ErrNoManifest         error = errors.New("no sharded store manifest")
+	ErrShardKeyType       error = errors.New("key type can not be sharded")
+)
+
+// ShardedStore is an AnyStore spreading keys by hash across several shards,
+// each an AnyStore with its own persistence file and lockfile. As every write
+// rewrites (or appends to) the persistence file of one shard only, writes
+// scale with the number of shards. Must be initialized using NewShardedStore.
+//
+// Operations on a single key go to the shard of the key. StoreMany,
+// DeleteMany, Apply, Rekey and Compact are executed shard by shard and are
+// therefore only atomic per shard. Len, Keys, Range and Snapshot combine the
+// results of all shards. Run and Update lock all shards (in order) for the
+// duration of the function, Update commits the shards one by one after
+// transaction returns nil.
+//
+// Keys must hash the same in every process: booleans, numbers, strings and
+// arrays and structs of them. Keys holding pointers, maps, slices, channels,
+// functions or interfaces (e.g time.Time) return ErrShardKeyType.
+//
+// The shard count is recorded in a manifest (JSON) in the persistence file
+// (Options.PersistenceFile), the shards are stored next to it in
+// PersistenceFile + ".shard-<i>-of-<n>". Use Reshard to change the number of
+// shards.
+type ShardedStore struct {
+	file   string
+	shards []AnyStore
+}
+
+// shardManifest is the content of the manifest of a ShardedStore.
+type shardManifest struct {
+	Version int `json:"version"`
+	Shards  int `json:"shards"`
+}
+
+// NewShardedStore returns a ShardedStore with shards shards each configured
+// using o (PersistenceFile is the manifest, see ShardedStore). If the manifest
+// exists, shards must match the shard count recorded in it or be 0 to use the
+// recorded count, otherwise ErrShardCountMismatch is returned. A new store
+// uses DefaultShards if shards is 0. Options.Backend is not supported.
+func NewShardedStore(o *Options, shards int) (*ShardedStore, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	if shards < 0 || shards > maxShards {
+		return nil, ErrInvalidShardCount
+	}
+	s := &ShardedStore{}
+	options := *o
+	if o.EnablePersistence {
+		if o.Backend != nil {
+			return nil, ErrShardedBackend
+		}
+		s.file = o.PersistenceFile
+		if s.file == "" {
+			s.file = DefaultPersistenceFile
+		}
+		n, err := ensureManifest(s.file, shards)
+		if err != nil {
+			return nil, err
+		}
+		shards = n
+	} else if shards == 0 {
+		shards = DefaultShards
+	}
+	for i := 0; i < shards; i++ {
+		if o.EnablePersistence {
+			options.PersistenceFile = shardFile(s.file, i, shards)
+		}
+		shard, err := newAnyStore(&options)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, shard)
+	}
+	return s, nil
+}
+
+// Reshard changes the number of shards of the ShardedStore configured by o
+// (PersistenceFile is the manifest) to shards. All keys are read from the
+// current shards and written to new shard files, then the manifest is
+// replaced and the old shard files are removed. Reshard must be run offline,
+// no process may use the store while it is resharded.
+func Reshard(o *Options, shards int) error {
+	if o == nil {
+		o = &Options{}
+	}
+	if shards < 1 || shards > maxShards {
+		return ErrInvalidShardCount
+	}
+	options := *o
+	options.EnablePersistence = true
+	if options.PersistenceFile == "" {
+		options.PersistenceFile = DefaultPersistenceFile
+	}
+	file := options.PersistenceFile
+	current, err := readManifest(file)
+	if err != nil {
+		return err
+	}
+	if current == shards {
+		return nil
+	}
+	old, err := NewShardedStore(&options, current)
+	if err != nil {
+		return err
+	}
+	snapshot, err := old.Snapshot()
+	if closeErr := old.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < shards; i++ {
+		options.PersistenceFile = shardFile(file, i, shards)
+		shard, err := newAnyStore(&options)
+		if err != nil {
+			return err
+		}
+		shard.mutex.Lock()
+		err = shard.mutate(func(kv anyMap) (bool, error) {
+			for k := range kv {
+				delete(kv, k)
+			}
+			for k, v := range snapshot.kv {
+				n, err := shardIndex(k, shards)
+				if err != nil {
+					return false, err
+				}
+				if n == i {
+					kv[k] = v
+				}
+			}
+			return true, nil
+		})
+		shard.mutex.Unlock()
+		if closeErr := shard.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeManifest(file, shards); err != nil {
+		return err
+	}
+	path, err := expandHome(file)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < current; i++ {
+		if err := os.Remove(shardFile(path, i, current)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shards returns the number of shards.
+func (s *ShardedStore) Shards() int {
+	return len(s.shards)
+}
+
+// shardFile returns the persistence file of shard i of n.
+func shardFile(file string, i, n int) string {
+	return fmt.Sprintf("%s.shard-%d-of-%d", file, i, n)
+}
+
+// shardIndex returns the shard of key among shards shards. The hash (FNV-1a
+// of the type and value of key) must never change as it decides where keys
+// are persisted. Keys not formatting the same in every process (see
+// stableKey) return ErrShardKeyType.
+func shardIndex(key any, shards int) (int, error) {
+	if key != nil && !stableKey(reflect.TypeOf(key)) {
+		return 0, fmt.Errorf("%w: %T", ErrShardKeyType, key)
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:%v", key, key)
+	return int(h.Sum64() % uint64(shards)), nil
+}
+
+// stableKey returns true if values of type t format (%v) the same in every
+// process: booleans, numbers, strings and arrays and structs of them.
+// Pointers (e.g the location of a time.Time) format by address.
+func stableKey(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return stableKey(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !stableKey(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// shard returns the shard of key.
+func (s *ShardedStore) shard(key any) (AnyStore, error) {
+	i, err := shardIndex(key, len(s.shards))
+	if err != nil {
+		return nil, err
+	}
+	return s.shards[i], nil
+}
+
+// readManifest returns the shard count recorded in the manifest file,
+// ErrNoManifest if there is none.
+func readManifest(file string) (int, error) {
+	backend, err := NewFileBackend(file)
+	if err != nil {
+		return 0, err
+	}
+	defer backend.Close()
+	data, _, err := backend.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	return parseManifest(file, data)
+}
+
+// parseManifest returns the shard count of manifest data.
+func parseManifest(file string, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoManifest, file)
+	}
+	var manifest shardManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return 0, fmt.Errorf("%s: invalid manifest: %w", file, err)
+	}
+	if manifest.Version != manifestVersion {
+		return 0, fmt.Errorf("%s: unsupported manifest version %d", file, manifest.Version)
+	}
+	if manifest.Shards < 1 || manifest.Shards > maxShards {
+		return 0, fmt.Errorf("%s: %w", file, ErrInvalidShardCount)
+	}
+	return manifest.Shards, nil
+}
+
+// ensureManifest returns the shard count of the manifest file, creating it
+// with shards (or DefaultShards if 0) shards if it does not exist. Returns
+// ErrShardCountMismatch if shards is not 0 and differs from the manifest.
+func ensureManifest(file string, shards int) (int, error) {
+	backend, err := NewFileBackend(file)
+	if err != nil {
+		return 0, err
+	}
+	defer backend.Close()
+	if err := backend.Lock(); err != nil {
+		return 0, err
+	}
+	defer backend.Unlock()
+	data, _, err := backend.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > 0 {
+		n, err := parseManifest(file, data)
+		if err != nil {
+			return 0, err
+		}
+		if shards != 0 && shards != n {
+			return 0, fmt.Errorf("%w: %d != %d", ErrShardCountMismatch, shards, n)
+		}
+		return n, nil
+	}
+	if shards == 0 {
+		shards = DefaultShards
+	}
+	return shards, replaceManifest(backend, shards)
+}
+
+// writeManifest replaces the manifest file with one recording shards shards.
+func writeManifest(file string, shards int) error {
+	backend, err := NewFileBackend(file)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	if err := backend.Lock(); err != nil {
+		return err
+	}
+	defer backend.Unlock()
+	return replaceManifest(backend, shards)
+}
+
+// replaceManifest replaces the content of backend with a manifest, caller
+// must hold the lock of backend.
+func replaceManifest(backend Backend, shards int) error {
+	data, err := json.Marshal(shardManifest{Version: manifestVersion, Shards: shards})
+	if err != nil {
+		return err
+	}
+	_, err = backend.Replace(append(data, '\n'))
+	return err
+}
+
+func (s *ShardedStore) SetPersistenceFile(file string) (AnyStore, error) {
+	if _, err := ensureManifest(file, len(s.shards)); err != nil {
+		return s, err
+	}
+	for i, shard := range s.shards {
+		if _, err := shard.SetPersistenceFile(shardFile(file, i, len(s.shards))); err != nil {
+			return s, err
+		}
+	}
+	s.file = file
+	return s, nil
+}
+
+func (s *ShardedStore) EnablePersistence() AnyStore {
+	for _, shard := range s.shards {
+		shard.EnablePersistence()
+	}
+	return s
+}
+
+func (s *ShardedStore) DisablePersistence() AnyStore {
+	for _, shard := range s.shards {
+		shard.DisablePersistence()
+	}
+	return s
+}
+
+func (s *ShardedStore) SetEncryptionKey(key string) (AnyStore, error) {
+	for _, shard := range s.shards {
+		if _, err := shard.SetEncryptionKey(key); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// Rekey re-encrypts the shards one by one (see AnyStore.Rekey). If rekeying a
+// shard fails, the shards before it are already using newKey.
+func (s *ShardedStore) Rekey(oldKey, newKey string) error {
+	for i, shard := range s.shards {
+		if err := shard.Rekey(oldKey, newKey); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) GetEncryptionKeyBytes() []byte {
+	return s.shards[0].GetEncryptionKeyBytes()
+}
+
+// HasKey returns false for keys that can not be sharded (ErrShardKeyType).
+func (s *ShardedStore) HasKey(key any) bool {
+	shard, err := s.shard(key)
+	if err != nil {
+		return false
+	}
+	return shard.HasKey(key)
+}
+
+func (s *ShardedStore) Load(key any) (any, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Load(key)
+}
+
+func (s *ShardedStore) Store(key any, value any) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Store(key, value)
+}
+
+func (s *ShardedStore) StoreWithTTL(key any, value any, ttl time.Duration) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.StoreWithTTL(key, value, ttl)
+}
+
+func (s *ShardedStore) Delete(key any) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.Delete(key)
+}
+
+func (s *ShardedStore) CompareAndSwap(key, old, new any) (bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return false, err
+	}
+	return shard.CompareAndSwap(key, old, new)
+}
+
+func (s *ShardedStore) CompareAndDelete(key, old any) (bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return false, err
+	}
+	return shard.CompareAndDelete(key, old)
+}
+
+func (s *ShardedStore) LoadOrStore(key, value any) (any, bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return shard.LoadOrStore(key, value)
+}
+
+func (s *ShardedStore) LoadAndDelete(key any) (any, bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return shard.LoadAndDelete(key)
+}
+
+func (s *ShardedStore) Swap(key, value any) (any, bool, error) {
+	shard, err := s.shard(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return shard.Swap(key, value)
+}
+
+func (s *ShardedStore) StoreMany(kv map[any]any) error {
+	batches := make([]map[any]any, len(s.shards))
+	for k, v := range kv {
+		i, err := shardIndex(k, len(s.shards))
+		if err != nil {
+			return err
+		}
+		if batches[i] == nil {
+			batches[i] = make(map[any]any)
+		}
+		batches[i][k] = v
+	}
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.shards[i].StoreMany(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) DeleteMany(keys []any) error {
+	batches := make([][]any, len(s.shards))
+	for _, k := range keys {
+		i, err := shardIndex(k, len(s.shards))
+		if err != nil {
+			return err
+		}
+		batches[i] = append(batches[i], k)
+	}
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.shards[i].DeleteMany(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply executes ops grouped by shard, in order within each shard. All ops are
+// validated before any is applied, but a shard failing to persist its batch
+// does not roll back the batches of the shards before it.
+func (s *ShardedStore) Apply(ops []Op) error {
+	batches := make([][]Op, len(s.shards))
+	for i, op := range ops {
+		switch op.Type {
+		case OpStore, OpDelete:
+		default:
+			return fmt.Errorf("%w: %s (op %d)", ErrUnknownOp, op.Type, i)
+		}
+		n, err := shardIndex(op.Key, len(s.shards))
+		if err != nil {
+			return fmt.Errorf("%w (op %d)", err, i)
+		}
+		batches[n] = append(batches[n], op)
+	}
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := s.shards[i].Apply(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) Len() (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		n, err := shard.Len()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *ShardedStore) Keys() ([]any, error) {
+	keys := []any{}
+	for _, shard := range s.shards {
+		k, err := shard.Keys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// Range calls f for each key and value of each shard in turn (see
+// AnyStore.Range), each shard is loaded once when its turn comes.
+func (s *ShardedStore) Range(f func(key, value any) bool) error {
+	stopped := false
+	for _, shard := range s.shards {
+		if err := shard.Range(func(key, value any) bool {
+			stopped = !f(key, value)
+			return !stopped
+		}); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Snapshot returns an immutable read-only view combining snapshots of all
+// shards, taken one after the other.
+func (s *ShardedStore) Snapshot() (*Snapshot, error) {
+	now := time.Now().UnixNano()
+	kv := make(anyMap)
+	for _, shard := range s.shards {
+		snapshot, err := shard.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range snapshot.kv {
+			kv[k] = v
+		}
+	}
+	return &Snapshot{kv: kv, now: now}, nil
+}
+
+// Run locks all shards (in order) and executes atomicOperation with a
+// ShardedStore of the locked shards (see AnyStore.Run).
+func (s *ShardedStore) Run(atomicOperation func(s AnyStore) error) error {
+	locked := make([]AnyStore, len(s.shards))
+	var run func(i int) error
+	run = func(i int) error {
+		if i == len(s.shards) {
+			return atomicOperation(&ShardedStore{file: s.file, shards: locked})
+		}
+		return s.shards[i].Run(func(shard AnyStore) error {
+			locked[i] = shard
+			return run(i + 1)
+		})
+	}
+	return run(0)
+}
+
+// Update executes transaction in a read-write transaction spanning all shards
+// (see AnyStore.Update). The lockfiles of all shards are flocked (in order)
+// for the entire duration of the transaction. If transaction returns nil, the
+// shards are committed one by one (in reverse order), a shard failing to
+// persist does not roll back the shards committed before it.
+func (s *ShardedStore) Update(transaction func(tx AnyStore) error) error {
+	txs := make([]AnyStore, len(s.shards))
+	var update func(i int) error
+	update = func(i int) error {
+		if i == len(s.shards) {
+			return transaction(&ShardedStore{file: s.file, shards: txs})
+		}
+		return s.shards[i].Update(func(tx AnyStore) error {
+			txs[i] = tx
+			return update(i + 1)
+		})
+	}
+	return update(0)
+}
+
+func (s *ShardedStore) Compact() error {
+	for i, shard := range s.shards {
+		if err := shard.Compact(); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Watch merges the events of the shards holding keys (or of all shards if no
+// keys are given) into one channel (see AnyStore.Watch). The channel is closed
+// once the channels of all watched shards are closed.
+func (s *ShardedStore) Watch(ctx context.Context, keys ...any) <-chan Event {
+	ctx, cancel := context.WithCancel(ctx)
+	var channels []<-chan Event
+	if len(keys) == 0 {
+		for _, shard := range s.shards {
+			channels = append(channels, shard.Watch(ctx))
+		}
+	} else {
+		batches := make([][]any, len(s.shards))
+		for _, k := range keys {
+			// Keys that can not be sharded are never stored.
+			if i, err := shardIndex(k, len(s.shards)); err == nil {
+				batches[i] = append(batches[i], k)
+			}
+		}
+		for i, batch := range batches {
+			if len(batch) > 0 {
+				channels = append(channels, s.shards[i].Watch(ctx, batch...))
+			}
+		}
+	}
+	out := make(chan Event)
+	var wg sync.WaitGroup
+	for _, ch := range channels {
+		wg.Add(1)
+		go func(ch <-chan Event) {
+			defer wg.Done()
+			for event := range ch {
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					// Drain until the shard closes the channel.
+					for range ch {
+					}
+					return
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+	}()
+	return out
+}
+
+// Close closes all shards (see AnyStore.Close).
+func (s *ShardedStore) Close() error {
+	var errs []error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ShardedStore) Wipe() {
+	for _, shard := range s.shards {
+		shard.Wipe()
+	}
+}
+
+func (s *ShardedStore) load() error {
+	for _, shard := range s.shards {
+		if err := shard.load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) loadStoreAndSave(key any, value any, remove bool) error {
+	shard, err := s.shard(key)
+	if err != nil {
+		return err
+	}
+	return shard.loadStoreAndSave(key, value, remove)
+}
@@ -0,0 +1,346 @@
+package anystore_test
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestShardedStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sharded")
+	options := &anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+		EncryptionKey:     anystore.NewKey(),
+	}
+	var s anystore.AnyStore
+	s, err := anystore.NewShardedStore(options, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.Store(fmt.Sprintf("key%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StoreWithTTL("expired", true, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	// Every shard has its own persistence file.
+	for i := 0; i < 4; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s.shard-%d-of-4", file, i)); err != nil {
+			t.Errorf("expected shard file %d: %v", i, err)
+		}
+	}
+	s2, err := anystore.NewShardedStore(options, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s2.Shards(); n != 4 {
+		t.Errorf("expected the shard count from the manifest, got %d", n)
+	}
+	if n, err := s2.Len(); err != nil {
+		t.Fatal(err)
+	} else if n != 99 {
+		t.Errorf("expected 99 keys, got %d", n)
+	}
+	keys, err := s2.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 99 {
+		t.Errorf("expected 99 keys, got %d", len(keys))
+	}
+	sum := 0
+	if err := s2.Range(func(key, value any) bool {
+		sum += value.(int)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 4950 {
+		t.Errorf("expected sum 4950, got %d", sum)
+	}
+	visited := 0
+	if err := s2.Range(func(key, value any) bool {
+		visited++
+		return visited < 10
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 10 {
+		t.Errorf("expected Range to stop after 10 keys, got %d", visited)
+	}
+	if v, err := s2.Load("key42"); err != nil {
+		t.Fatal(err)
+	} else if v != 42 {
+		t.Errorf("expected 42, got %v", v)
+	}
+	if swapped, err := s2.CompareAndSwap("key42", 42, 4242); err != nil || !swapped {
+		t.Errorf("expected swap, got %v, %v", swapped, err)
+	}
+	if v, err := s.Load("key42"); err != nil {
+		t.Fatal(err)
+	} else if v != 4242 {
+		t.Errorf("expected 4242, got %v", v)
+	}
+	if _, err := anystore.NewShardedStore(options, 8); !errors.Is(err, anystore.ErrShardCountMismatch) {
+		t.Errorf("expected ErrShardCountMismatch, got %v", err)
+	}
+	for _, store := range []anystore.AnyStore{s, s2} {
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShardedStore_Batch(t *testing.T) {
+	s, err := anystore.NewShardedStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "sharded"),
+	}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	kv := make(map[any]any)
+	for i := 0; i < 30; i++ {
+		kv[i] = fmt.Sprint(i)
+	}
+	if err := s.StoreMany(kv); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteMany([]any{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply([]anystore.Op{{Type: anystore.OpStore, Key: 0, Value: "zero"}, {Type: 42, Key: 1}}); !errors.Is(err, anystore.ErrUnknownOp) {
+		t.Errorf("expected ErrUnknownOp, got %v", err)
+	}
+	if s.HasKey(0) {
+		t.Error("expected no op to be applied")
+	}
+	if err := s.Apply([]anystore.Op{{Type: anystore.OpStore, Key: 0, Value: "zero"}, {Type: anystore.OpDelete, Key: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := snapshot.Len(); n != 27 {
+		t.Errorf("expected 27 keys, got %d", n)
+	}
+	if v, ok := snapshot.Load(0); !ok || v != "zero" {
+		t.Errorf("expected zero, got %v", v)
+	}
+}
+
+func TestShardedStore_Update(t *testing.T) {
+	s, err := anystore.NewShardedStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "sharded"),
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Update(func(tx anystore.AnyStore) error {
+		for i := 0; i < 20; i++ {
+			if err := tx.Store(i, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rollback := errors.New("rollback")
+	if err := s.Update(func(tx anystore.AnyStore) error {
+		for i := 0; i < 20; i++ {
+			if err := tx.Delete(i); err != nil {
+				return err
+			}
+		}
+		if n, err := tx.Len(); err != nil || n != 0 {
+			t.Errorf("expected an empty transaction, got %d, %v", n, err)
+		}
+		return rollback
+	}); !errors.Is(err, rollback) {
+		t.Fatalf("expected rollback, got %v", err)
+	}
+	if n, err := s.Len(); err != nil {
+		t.Fatal(err)
+	} else if n != 20 {
+		t.Errorf("expected 20 keys after rollback, got %d", n)
+	}
+	if err := s.Run(func(locked anystore.AnyStore) error {
+		return locked.Store("run", true)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasKey("run") {
+		t.Error("expected key stored by Run")
+	}
+}
+
+func TestShardedStore_Watch(t *testing.T) {
+	s, err := anystore.NewShardedStore(nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Watch(ctx)
+	for i := 0; i < 10; i++ {
+		if err := s.Store(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[any]bool)
+	for len(seen) < 10 {
+		select {
+		case event := <-events:
+			seen[event.Key] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, got events for %v", seen)
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestReshard(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "sharded")
+	options := &anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   file,
+	}
+	s, err := anystore.NewShardedStore(options, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := s.Store(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StoreWithTTL("ttl", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := anystore.Reshard(options, 5); err != nil {
+		t.Fatal(err)
+	}
+	s, err = anystore.NewShardedStore(options, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Shards(); n != 5 {
+		t.Errorf("expected 5 shards, got %d", n)
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 51 {
+		t.Errorf("expected 51 keys, got %d", len(keys))
+	}
+	for i := 0; i < 50; i++ {
+		if v, err := s.Load(i); err != nil || v != i {
+			t.Errorf("expected %d, got %v, %v", i, v, err)
+		}
+	}
+	if v, err := s.Load("ttl"); err != nil || v != "value" {
+		t.Errorf("expected value, got %v, %v", v, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the manifest, the new shards and lockfiles remain.
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != "sharded" && filepath.Ext(name) != ".lock" && !isShardOf(name, 5) {
+			t.Errorf("unexpected file %s after reshard", name)
+		}
+	}
+	if err := anystore.Reshard(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(dir, "missing"),
+	}, 2); !errors.Is(err, anystore.ErrNoManifest) {
+		t.Errorf("expected ErrNoManifest, got %v", err)
+	}
+}
+
+// isShardOf returns true if name is a shard file of a store with n shards.
+func isShardOf(name string, n int) bool {
+	for i := 0; i < n; i++ {
+		if name == fmt.Sprintf("sharded.shard-%d-of-%d", i, n) {
+			return true
+		}
+	}
+	return false
+}
+
+type shardPoint struct{ X, Y int }
+
+func TestShardedStore_KeyType(t *testing.T) {
+	gob.Register(shardPoint{})
+	gob.Register([2]string{})
+	options := &anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "sharded"),
+	}
+	s, err := anystore.NewShardedStore(options, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if keys, err := s.Keys(); err != nil {
+		t.Fatal(err)
+	} else if keys == nil || len(keys) != 0 {
+		t.Errorf("expected an empty slice, got %#v", keys)
+	}
+	for _, key := range []any{new(int), time.Unix(1, 0), struct{ P *int }{}} {
+		if err := s.Store(key, true); !errors.Is(err, anystore.ErrShardKeyType) {
+			t.Errorf("%T: expected ErrShardKeyType, got %v", key, err)
+		}
+		if err := s.StoreMany(map[any]any{key: true}); !errors.Is(err, anystore.ErrShardKeyType) {
+			t.Errorf("%T: expected ErrShardKeyType, got %v", key, err)
+		}
+		if s.HasKey(key) {
+			t.Errorf("%T: expected no key", key)
+		}
+	}
+	keys := []any{shardPoint{1, 2}, [2]string{"a", "b"}, 1.5, "string"}
+	for _, key := range keys {
+		if err := s.Store(key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another instance finds the keys in the same shards.
+	s2, err := anystore.NewShardedStore(options, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	for _, key := range keys {
+		if !s2.HasKey(key) {
+			t.Errorf("expected key %v", key)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package anystore
+
+// Snapshot is an immutable read-only view of an AnyStore at the time
+// AnyStore.Snapshot was called. A Snapshot never reloads the persistence file
+// and is safe for concurrent use. Keys with a TTL are evaluated against the
+// time the snapshot was taken.
+type Snapshot struct {
+	kv  anyMap
+	now int64
+}
+
+// HasKey tests if key exists in the snapshot.
+func (s *Snapshot) HasKey(key any) bool {
+	_, ok := s.kv.load(key, s.now)
+	return ok
+}
+
+// Load retrieves the value of key. The ok result indicates whether key was
+// found in the snapshot.
+func (s *Snapshot) Load(key any) (value any, ok bool) {
+	return s.kv.load(key, s.now)
+}
+
+// Len returns number of keys in the snapshot.
+func (s *Snapshot) Len() int {
+	return s.kv.len(s.now)
+}
+
+// Keys returns a slice with all keys in the snapshot.
+func (s *Snapshot) Keys() []any {
+	return s.kv.keys(s.now)
+}
+
+// Range calls f sequentially for each key and value in the snapshot. If f
+// returns false, Range stops the iteration.
+func (s *Snapshot) Range(f func(key, value any) bool) {
+	s.kv.each(s.now, f)
+}
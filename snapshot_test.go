@@ -0,0 +1,108 @@
+package anystore_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Range(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := a.Store(i, i*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := 0
+	if err := a.Range(func(key, value any) bool {
+		if key.(int)*10 != value.(int) {
+			t.Errorf("unexpected value %v for key %v", value, key)
+		}
+		sum += value.(int)
+		// Storing from within Range must not deadlock.
+		if err := a.Store("inside", true); err != nil {
+			t.Error(err)
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 450 {
+		t.Errorf("expected sum 450, got %d", sum)
+	}
+	count := 0
+	if err := a.Range(func(key, value any) bool {
+		count++
+		return count < 3
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected Range to stop after 3 iterations, got %d", count)
+	}
+}
+
+func TestAnyStore_Snapshot_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-snapshot-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hola", "mundo"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Len() != 1 {
+		t.Errorf("expected snapshot Len() == 1, got %d", snapshot.Len())
+	}
+	if snapshot.HasKey("hola") {
+		t.Error("snapshot changed after Store")
+	}
+	if v, ok := snapshot.Load("hello"); !ok || v != "world" {
+		t.Errorf("expected hello=world in snapshot, got %v", v)
+	}
+	if keys := snapshot.Keys(); len(keys) != 1 || keys[0] != "hello" {
+		t.Errorf("unexpected snapshot keys %v", keys)
+	}
+	err = a.Run(func(s anystore.AnyStore) error {
+		n := 0
+		if err := s.Range(func(key, value any) bool {
+			n++
+			return true
+		}); err != nil {
+			return err
+		}
+		if n != 2 {
+			t.Errorf("expected 2 keys in Range, got %d", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
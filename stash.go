@@ -2,13 +2,13 @@ package anystore
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/ecdh"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
-	"strings"
+	"time"
 )
 
 var (
@@ -40,12 +40,65 @@ type StashConfig struct {
 	// (if File is not an empty string).
 	Writer io.WriteCloser
 
-	// GZip data before encryption.
+	// GZip data before encryption (see Options.GZipPersistenceFile). Unstash
+	// detects the compression of the stash regardless.
 	GZip bool
 
+	// Compression of the stash, overrides GZip (see Options.Compression).
+	Compression Compression
+
+	// Compression level, omit (or 0) to use the default level (see
+	// Options.CompressionLevel).
+	CompressionLevel int
+
 	// 16, 24 or 32 byte long base64-encoded string.
 	EncryptionKey string
 
+	// If not empty, derive the encryption key from Passphrase instead of using
+	// EncryptionKey (see Options.Passphrase).
+	Passphrase string
+
+	// Number of PBKDF2 iterations for new stashes, omit (or 0) to use
+	// DefaultPassphraseIterations.
+	PassphraseIterations int
+
+	// If not nil, use Keyring instead of Passphrase or EncryptionKey (see
+	// Options.Keyring).
+	Keyring *Keyring
+
+	// If not nil, use envelope encryption with KeyProvider instead of Keyring,
+	// Passphrase or EncryptionKey (see Options.KeyProvider).
+	KeyProvider KeyProvider
+
+	// If not empty, Stash encrypts a random file key to each X25519 public key
+	// in Recipients (see NewKeyPair) instead of using Keyring, Passphrase or
+	// EncryptionKey. Only the holders of the private keys can Unstash. Without
+	// Identity, the existing File can not be decrypted and Stash replaces it
+	// with a file holding only Key (other keys in File are lost).
+	Recipients []*ecdh.PublicKey
+
+	// X25519 private key used by Unstash to decrypt a stash encrypted to
+	// Recipients (see Options.Identity).
+	Identity *ecdh.PrivateKey
+
+	// Encryption of the stash, omit to use EncryptionAESGCM. With
+	// EncryptionNone the stash is written unencrypted and no key may be given
+	// (see Options.Encryption).
+	Encryption Encryption
+
+	// Codec of the stash, omit to use GobCodec. With other codecs, Thing is
+	// stored as the generic value it decodes to (e.g a JSON object) and
+	// Unstash converts it back into Thing (see Options.Codec).
+	Codec Codec
+
+	// If true, using the DefaultEncryptionKey returns ErrDefaultKeyInUse (see
+	// Options.RequireExplicitKey).
+	RequireExplicitKey bool
+
+	// If true and Passphrase is empty, EditThing prompts for the passphrase on
+	// the terminal (see ReadPassphrase).
+	PromptPassphrase bool
+
 	// Key name where to store Thing.
 	Key string
 
@@ -63,6 +116,12 @@ type StashConfig struct {
 	Editor string
 }
 
+// hasKey returns true if conf has a key source other than Passphrase or
+// EncryptionKey.
+func (conf *StashConfig) hasKey() bool {
+	return conf.Keyring != nil || conf.KeyProvider != nil || len(conf.Recipients) > 0 || conf.Identity != nil
+}
+
 // "stash, verb. to put (something of future use or value) in a safe or secret
 // place"
 //
@@ -73,9 +132,9 @@ type StashConfig struct {
 // guaranteed.
 //
 // The Stash and Unstash functions also support io.Reader and
-// io.Writer (io.WriteCloser). Reader/writer is essentially an
-// in-memory version of the physical DB file, Unstash does io.ReadAll
-// into memory in order to decrypt and de-GOB the data. A previous
+// io.Writer (io.WriteCloser). Reader/writer is essentially a
+// streamed version of the physical DB file, Unstash decrypts and
+// de-GOBs the data while reading it (see NewDecryptReader). A previous
 // file-Stash command can be Unstashed via the io.Reader. Unstash
 // prefers io.Reader when both StashConfig.File and StashConfig.Reader
 // are defined.
@@ -99,53 +158,41 @@ func Unstash(conf *StashConfig) error {
 		return ErrMissingReader
 	}
 	options := Options{
-		EnablePersistence:   true,
-		PersistenceFile:     conf.File,
-		GZipPersistenceFile: conf.GZip,
-		EncryptionKey:       conf.EncryptionKey,
+		EnablePersistence:    true,
+		PersistenceFile:      conf.File,
+		GZipPersistenceFile:  conf.GZip,
+		Compression:          conf.Compression,
+		CompressionLevel:     conf.CompressionLevel,
+		EncryptionKey:        conf.EncryptionKey,
+		Passphrase:           conf.Passphrase,
+		PassphraseIterations: conf.PassphraseIterations,
+		Keyring:              conf.Keyring,
+		KeyProvider:          conf.KeyProvider,
+		Recipients:           conf.Recipients,
+		Identity:             conf.Identity,
+		Encryption:           conf.Encryption,
+		Codec:                conf.Codec,
+		RequireExplicitKey:   conf.RequireExplicitKey,
 	}
 	// If we have an io.Reader, prefer it above File.
 	if conf.Reader != nil {
 		options.EnablePersistence = false
 	}
-	a, err := NewAnyStore(&options)
+	a, err := newAnyStore(&options)
 	if err != nil {
 		return err
 	}
 	defer a.Close()
+	defer a.Wipe()
 	var gobbedThing any
 	if conf.Reader != nil {
 		// Read encrypted anyMap
 		kv := make(anyMap)
-		data, err := io.ReadAll(conf.Reader)
-		if err != nil {
-			return err
-		}
-		decrypted, err := Decrypt(a.GetEncryptionKeyBytes(), data)
-		if err != nil {
-			return err
-		}
-		var in *gob.Decoder
-		if conf.GZip {
-			gzipReader, err := gzip.NewReader(bytes.NewReader(decrypted))
-			if err != nil {
-				if errors.Is(err, gzip.ErrHeader) {
-					return fmt.Errorf("%w (perhaps persistence is not gzipped?)", err)
-				}
-				return err
-			}
-			in = gob.NewDecoder(gzipReader)
-		} else {
-			in = gob.NewDecoder(bytes.NewReader(decrypted))
-		}
-		if err := in.Decode(&kv); err != nil {
-			if strings.Contains(err.Error(), "encoded unsigned integer out of range") && conf.GZip {
-				return fmt.Errorf("%w (perhaps persistence is gzipped?)", err)
-			}
+		if err := a.unmarshalFrom(conf.Reader, &kv); err != nil {
 			return err
 		}
 		var ok bool
-		gobbedThing, ok = kv[conf.Key]
+		gobbedThing, ok = kv.load(conf.Key, time.Now().UnixNano())
 		if !ok {
 			return ErrThingNotFound
 		}
@@ -157,8 +204,15 @@ func Unstash(conf *StashConfig) error {
 			return err
 		}
 	}
-	// GOB encoded thing came from either file or io.Reader.
+	// GOB encoded thing came from either file or io.Reader, a thing stashed
+	// using another codec is a generic value.
 	thing, ok := gobbedThing.([]byte)
+	if !ok && gobbedThing != nil {
+		if err := assign(reflect.ValueOf(conf.Thing).Elem(), gobbedThing); err != nil {
+			return fmt.Errorf("decode Thing: %w", err)
+		}
+		return nil
+	}
 	if !ok {
 		if conf.DefaultThing != nil {
 			if reflect.TypeOf(conf.Thing) != reflect.TypeOf(conf.DefaultThing) {
@@ -172,6 +226,8 @@ func Unstash(conf *StashConfig) error {
 		}
 		return ErrThingNotFound
 	}
+	// The GOB encoded thing is not needed after decoding.
+	defer wipe(thing)
 	g := gob.NewDecoder(bytes.NewReader(thing))
 	// Decode into wherever StashConfig.Thing is pointing to.
 	if err := g.Decode(conf.Thing); err != nil {
@@ -187,8 +243,8 @@ func Unstash(conf *StashConfig) error {
 // file, but Stash and Unstash can also be used with an io.Writer
 // (io.WriteCloser) and an io.Reader for arbitrary stashing/unstashing. Stash
 // always closes the writer on exit (why it's an io.WriteCloser). The
-// reader/writers are essentially in-memory versions of the physical DB file,
-// Unstash does io.ReadAll into memory in order to decrypt and de-GOB it.
+// reader/writers are essentially streamed versions of the physical DB file,
+// Stash GOBs and encrypts while writing (see NewEncryptWriter).
 //
 // StashConfig instructs how functions anystore.Stash and anystore.Unstash
 // should save/load a "stash". If Reader is not nil and File is not an empty
@@ -217,9 +273,20 @@ func Stash(conf *StashConfig) error {
 	}
 
 	options := Options{
-		PersistenceFile:     conf.File,
-		GZipPersistenceFile: conf.GZip,
-		EncryptionKey:       conf.EncryptionKey,
+		PersistenceFile:      conf.File,
+		GZipPersistenceFile:  conf.GZip,
+		Compression:          conf.Compression,
+		CompressionLevel:     conf.CompressionLevel,
+		EncryptionKey:        conf.EncryptionKey,
+		Passphrase:           conf.Passphrase,
+		PassphraseIterations: conf.PassphraseIterations,
+		Keyring:              conf.Keyring,
+		KeyProvider:          conf.KeyProvider,
+		Recipients:           conf.Recipients,
+		Identity:             conf.Identity,
+		Encryption:           conf.Encryption,
+		Codec:                conf.Codec,
+		RequireExplicitKey:   conf.RequireExplicitKey,
 	}
 	if conf.File == "" {
 		options.EnablePersistence = false
@@ -227,23 +294,44 @@ func Stash(conf *StashConfig) error {
 		options.EnablePersistence = true
 	}
 
-	a, err := NewAnyStore(&options)
+	a, err := newAnyStore(&options)
 	if err != nil {
 		return err
 	}
 	defer a.Close()
+	defer a.Wipe()
 
 	// Use gob to store the struct (or other value) instead of re-inventing
 	// dereference of all pointers. It is also unlikely that the interface stored
 	// is registered with gob in the downstream anystore package.
 	var thing bytes.Buffer
-	g := gob.NewEncoder(&thing)
-	if err := g.Encode(conf.Thing); err != nil {
-		return fmt.Errorf("gob.Encode of StashConfig.Thing: %w", err)
+	defer func() { wipe(thing.Bytes()) }()
+	var stored any
+	if codec := a.getCodec(); codec.ID() == codecGob {
+		g := gob.NewEncoder(&thing)
+		if err := g.Encode(conf.Thing); err != nil {
+			return fmt.Errorf("gob.Encode of StashConfig.Thing: %w", err)
+		}
+		stored = thing.Bytes()
+	} else {
+		// Store the generic value the thing decodes to (e.g a JSON object),
+		// keeping the stash readable without the Go type.
+		if err := codec.Encode(&thing, conf.Thing); err != nil {
+			return fmt.Errorf("encode StashConfig.Thing: %w", err)
+		}
+		if err := codec.Decode(bytes.NewReader(thing.Bytes()), &stored); err != nil {
+			return fmt.Errorf("decode StashConfig.Thing: %w", err)
+		}
 	}
 	// Persist to file if filename was not an empty string.
 	if conf.File != "" {
-		if err := a.Store(conf.Key, thing.Bytes()); err != nil {
+		if len(conf.Recipients) > 0 && conf.Identity == nil {
+			// Encrypting to recipients without an identity, the existing
+			// file can not be loaded and modified, it is replaced.
+			if err := a.replaceWith(anyMap{conf.Key: stored}); err != nil {
+				return err
+			}
+		} else if err := a.Store(conf.Key, stored); err != nil {
 			return err
 		}
 	}
@@ -251,33 +339,9 @@ func Stash(conf *StashConfig) error {
 	// emulated (AnyStore does not implement io.Writer or io.Reader).
 	if conf.Writer != nil {
 		kv := make(anyMap)
-		kv[conf.Key] = thing.Bytes()
-		var output bytes.Buffer
-		var out *gob.Encoder
-		var gzipWriter *gzip.Writer
-		if conf.GZip {
-			gzipWriter = gzip.NewWriter(&output)
-			out = gob.NewEncoder(gzipWriter)
-		} else {
-			out = gob.NewEncoder(&output)
-		}
-		if err := out.Encode(kv); err != nil {
-			if gzipWriter != nil {
-				gzipWriter.Close()
-			}
-			return err
-		}
-		if gzipWriter != nil {
-			gzipWriter.Close()
-		}
-		encrypted, err := Encrypt(a.GetEncryptionKeyBytes(), output.Bytes())
-		if err != nil {
-			return err
-		}
-		if n, err := conf.Writer.Write(encrypted); err != nil {
+		kv[conf.Key] = stored
+		if err := a.marshalTo(conf.Writer, kv); err != nil {
 			return err
-		} else if n != len(encrypted) {
-			return ErrWroteTooLittle
 		}
 	}
 	return nil
@@ -301,15 +365,26 @@ func (b *BytesBufferWriteCloser) Close() error {
 func NewStashReader(conf *StashConfig) (*BytesBufferWriteCloser, error) {
 	var buf BytesBufferWriteCloser
 	newConf := &StashConfig{
-		File:          "",
-		Reader:        nil,
-		Writer:        &buf,
-		GZip:          conf.GZip,
-		EncryptionKey: conf.EncryptionKey,
-		Key:           conf.Key,
-		Thing:         conf.Thing,
-		DefaultThing:  conf.DefaultThing,
-		Editor:        conf.Editor,
+		File:                 "",
+		Reader:               nil,
+		Writer:               &buf,
+		GZip:                 conf.GZip,
+		Compression:          conf.Compression,
+		CompressionLevel:     conf.CompressionLevel,
+		EncryptionKey:        conf.EncryptionKey,
+		Passphrase:           conf.Passphrase,
+		PassphraseIterations: conf.PassphraseIterations,
+		Keyring:              conf.Keyring,
+		KeyProvider:          conf.KeyProvider,
+		Recipients:           conf.Recipients,
+		Identity:             conf.Identity,
+		Encryption:           conf.Encryption,
+		Codec:                conf.Codec,
+		RequireExplicitKey:   conf.RequireExplicitKey,
+		Key:                  conf.Key,
+		Thing:                conf.Thing,
+		DefaultThing:         conf.DefaultThing,
+		Editor:               conf.Editor,
 	}
 	if err := Stash(newConf); err != nil {
 		return nil, err
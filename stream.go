@@ -0,0 +1,367 @@
+package anystore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// streamChunkSize is the size of the plaintext of each chunk written by
+	// NewEncryptWriter.
+	streamChunkSize int = 64 * 1024
+	// maxStreamChunkSize limits the chunk size accepted from a header.
+	maxStreamChunkSize int = 16 * 1024 * 1024
+)
+
+// NewEncryptWriter returns an io.WriteCloser encrypting everything written to
+// it into w using a 16, 24 or 32 byte long master key. Data is split into
+// chunks which are encrypted and authenticated individually (see below),
+// memory use is independent of the size of the data. Close must be called to
+// write the final chunk, it does not close w.
+//
+// The output starts with the same header as Encrypt (with a chunk size field
+// instead of a nonce) followed by the chunks. Each chunk is sealed using
+// AES-256-GCM with the header as associated data and a nonce made of the
+// sequence number of the chunk and a flag marking the final chunk, so that
+// reordered, dropped or truncated chunks fail authentication. Unlike
+// Encrypt, the output is authenticated by AES-GCM only (no trailing HMAC):
+//
+//	b = bytes
+//	["ANYE"][version_1_b][header_length_2_b][header_fields]([cipherdata][tag_16_b])...
+func NewEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrKeyLength
+	}
+	return newEncryptWriter(rawKey(key), w, nil)
+}
+
+// NewDecryptReader returns an io.Reader decrypting data read from r using a
+// 16, 24 or 32 byte long key. Data written by NewEncryptWriter is decrypted
+// and authenticated one chunk at a time, any other format supported by
+// Decrypt is read into memory and decrypted as a whole. Reading returns
+// ErrAuthenticationFailed (or ErrHMACValidationFailed) if the key is wrong or
+// the data is corrupt, truncated or tampered with.
+func NewDecryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrKeyLength
+	}
+	decrypted, _, err := newDecryptReader(rawKey(key), r)
+	return decrypted, err
+}
+
+// encryptWriter implements NewEncryptWriter.
+type encryptWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	aad    []byte
+	buf    []byte
+	sealed []byte
+	seq    uint64
+	err    error
+	closed bool
+}
+
+// newEncryptWriter implements NewEncryptWriter using the master key from keys
+// adding fields to the header, the header is written to w immediately.
+func newEncryptWriter(keys keySource, w io.Writer, fields header) (*encryptWriter, error) {
+	key, keyFields, err := keys.sealKey()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	encryptionKey := deriveEncryptionKey(key, salt)
+	gcm, err := newGCM(encryptionKey)
+	wipe(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	h := header{{tag: tagCipher, value: []byte{cipherAESGCM}}}
+	h = append(h, keyFields...)
+	h = append(h,
+		headerField{tag: tagKDF, value: []byte{kdfHKDFSHA256}},
+		headerField{tag: tagSalt, value: salt},
+		headerField{tag: tagChunkSize, value: binary.BigEndian.AppendUint32(nil, uint32(streamChunkSize))},
+	)
+	h = append(h, fields...)
+	e := &encryptWriter{
+		w:      w,
+		gcm:    gcm,
+		aad:    h.marshal(),
+		buf:    make([]byte, 0, streamChunkSize),
+		sealed: make([]byte, 0, streamChunkSize+gcm.Overhead()),
+	}
+	if err := e.write(e.aad); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, the final
+		// chunk is sealed by Close.
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals and writes the final chunk, it does not close the underlying
+// writer.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err != nil {
+		return e.err
+	}
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered plaintext as the next chunk.
+func (e *encryptWriter) seal(final bool) error {
+	e.sealed = e.gcm.Seal(e.sealed[:0], streamNonce(e.seq, final), e.buf, e.aad)
+	e.seq++
+	wipe(e.buf)
+	e.buf = e.buf[:0]
+	return e.write(e.sealed)
+}
+
+func (e *encryptWriter) write(p []byte) error {
+	if n, err := e.w.Write(p); err != nil {
+		e.err = err
+	} else if n != len(p) {
+		e.err = ErrWroteTooLittle
+	}
+	return e.err
+}
+
+// streamNonce returns the AES-GCM nonce of chunk seq.
+func streamNonce(seq uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], seq)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// decryptReader implements NewDecryptReader for streamed data.
+type decryptReader struct {
+	r         *bufio.Reader
+	gcm       cipher.AEAD
+	aad       []byte
+	chunkSize int
+	sealed    []byte
+	out       []byte
+	plain     []byte
+	seq       uint64
+	final     bool
+	err       error
+}
+
+// newDecryptReader implements NewDecryptReader using the candidate master keys
+// from keys, also returning the header of the data (nil for the legacy
+// format). The first chunk is read and authenticated immediately, an error is
+// returned if no candidate key opens it.
+func newDecryptReader(keys keySource, r io.Reader) (io.Reader, header, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(formatPrefixSize)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !isFormatted(prefix) {
+		return decryptAll(keys, br)
+	}
+	size := int(binary.BigEndian.Uint16(prefix[len(formatMagic)+1:]))
+	raw := make([]byte, formatPrefixSize+size)
+	if n, err := io.ReadFull(br, raw); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// Let decrypt handle (or report) short data, e.g legacy data
+			// starting with the magic by chance.
+			return decryptAll(keys, bytes.NewReader(raw[:n]))
+		}
+		return nil, nil, err
+	}
+	h, _, _, err := parseHeader(raw)
+	value, ok := h.get(tagChunkSize)
+	if err != nil || !ok {
+		return decryptAll(keys, io.MultiReader(bytes.NewReader(raw), br))
+	}
+	if err := checkHeader(h); err != nil {
+		return nil, nil, err
+	}
+	if len(value) != 4 {
+		return nil, nil, fmt.Errorf("%w: invalid chunk size", ErrUnsupportedFormat)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(value))
+	if chunkSize < 1 || chunkSize > maxStreamChunkSize {
+		return nil, nil, fmt.Errorf("%w: invalid chunk size", ErrUnsupportedFormat)
+	}
+	candidates, err := keys.openKeys(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &decryptReader{
+		r:         br,
+		aad:       raw,
+		chunkSize: chunkSize,
+	}
+	if err := d.readChunk(); err != nil {
+		return nil, nil, err
+	}
+	err = ErrAuthenticationFailed
+	for _, key := range candidates {
+		if d.gcm, err = streamGCM(key, h); err != nil {
+			continue
+		}
+		if err = d.openChunk(); err == nil {
+			return d, h, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// decryptAll reads r into memory and decrypts it using decrypt.
+func decryptAll(keys keySource, r io.Reader) (io.Reader, header, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	deciphered, err := decrypt(keys, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h header
+	if isFormatted(data) {
+		h, _, _, _ = parseHeader(data)
+	}
+	return &wipingReader{data: deciphered}, h, nil
+}
+
+// wipingReader reads data, zeroing it once it has been read entirely.
+type wipingReader struct {
+	data []byte
+	off  int
+}
+
+func (w *wipingReader) Read(p []byte) (int, error) {
+	if w.off >= len(w.data) {
+		wipe(w.data)
+		return 0, io.EOF
+	}
+	n := copy(p, w.data[w.off:])
+	w.off += n
+	return n, nil
+}
+
+// decryptStream decrypts streamed data held in memory.
+func decryptStream(keys keySource, data []byte) ([]byte, error) {
+	r, _, err := newDecryptReader(keys, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// streamGCM returns the AES-GCM AEAD of streamed data with header h using
+// master key key.
+func streamGCM(key []byte, h header) (cipher.AEAD, error) {
+	if kdf, ok := h.get(tagKDF); !ok || len(kdf) != 1 || kdf[0] != kdfHKDFSHA256 {
+		return nil, fmt.Errorf("%w: unknown KDF", ErrUnsupportedFormat)
+	}
+	salt, ok := h.get(tagSalt)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing salt", ErrUnsupportedFormat)
+	}
+	encryptionKey := deriveEncryptionKey(key, salt)
+	defer wipe(encryptionKey)
+	return newGCM(encryptionKey)
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		// Zero the plaintext of the consumed chunk.
+		wipe(d.out)
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		if d.err = d.readChunk(); d.err != nil {
+			return 0, d.err
+		}
+		if d.err = d.openChunk(); d.err != nil {
+			return 0, d.err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// readChunk reads the next sealed chunk, the chunk is final if it is
+// followed by end of file.
+func (d *decryptReader) readChunk() error {
+	if d.sealed == nil {
+		d.sealed = make([]byte, d.chunkSize+16)
+	}
+	n, err := io.ReadFull(d.r, d.sealed[:cap(d.sealed)])
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF, io.EOF:
+		d.final = true
+	default:
+		return err
+	}
+	if n < 16 {
+		return fmt.Errorf("%w: truncated stream", ErrAuthenticationFailed)
+	}
+	d.sealed = d.sealed[:n]
+	return nil
+}
+
+// openChunk authenticates and decrypts the chunk read by readChunk.
+func (d *decryptReader) openChunk() error {
+	plain, err := d.gcm.Open(d.out[:0], streamNonce(d.seq, d.final), d.sealed, d.aad)
+	if err != nil {
+		return ErrAuthenticationFailed
+	}
+	d.seq++
+	d.out = plain
+	d.plain = plain
+	return nil
+}
@@ -0,0 +1,152 @@
+package anystore_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+// chunkSize is the plaintext chunk size used by NewEncryptWriter, sealed
+// chunks are 16 bytes longer.
+const chunkSize = 64 * 1024
+
+func encryptStream(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := anystore.NewEncryptWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes to cross chunk boundaries.
+	for p := data; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptStream(key, data []byte) ([]byte, error) {
+	r, err := anystore.NewDecryptReader(key, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestNewEncryptWriter(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := encryptStream(t, key, data)
+		if got, err := decryptStream(key, encrypted); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+		// Decrypt handles streamed data as well.
+		if got, err := anystore.Decrypt(key, encrypted); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("size %d: Decrypt differs", size)
+		}
+	}
+}
+
+func TestNewDecryptReader(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*chunkSize+5)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encryptStream(t, key, data)
+	sealed := chunkSize + 16
+	headerSize := len(encrypted) - 3*sealed - (5 + 16)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[headerSize+sealed+100] ^= 1
+	if _, err := decryptStream(key, tampered); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("tampered: expected ErrAuthenticationFailed, got %v", err)
+	}
+	truncated := encrypted[:len(encrypted)-(5+16)]
+	if _, err := decryptStream(key, truncated); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("truncated: expected ErrAuthenticationFailed, got %v", err)
+	}
+	reordered := bytes.Clone(encrypted[:headerSize])
+	reordered = append(reordered, encrypted[headerSize+sealed:headerSize+2*sealed]...)
+	reordered = append(reordered, encrypted[headerSize:headerSize+sealed]...)
+	reordered = append(reordered, encrypted[headerSize+2*sealed:]...)
+	if _, err := decryptStream(key, reordered); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("reordered: expected ErrAuthenticationFailed, got %v", err)
+	}
+	wrongKey := make([]byte, 32)
+	if _, err := decryptStream(wrongKey, encrypted); !errors.Is(err, anystore.ErrAuthenticationFailed) {
+		t.Errorf("wrong key: expected ErrAuthenticationFailed, got %v", err)
+	}
+
+	// Data not written by NewEncryptWriter is decrypted as a whole.
+	whole, err := anystore.Encrypt(key, []byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decryptStream(key, whole); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "hello world" {
+		t.Errorf("expected hello world, got %q", got)
+	}
+	legacy := legacyEncrypt(t, key, []byte("legacy"))
+	if got, err := decryptStream(key, legacy); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "legacy" {
+		t.Errorf("expected legacy, got %q", got)
+	}
+}
+
+func TestStash_stream(t *testing.T) {
+	key := anystore.NewKey()
+	thing := &Thing{Name: strptr("Stream"), Number: 42, Description: string(make([]byte, 5*chunkSize))}
+	var buf anystore.BytesBufferWriteCloser
+	if err := anystore.Stash(&anystore.StashConfig{
+		Writer:        &buf,
+		GZip:          true,
+		EncryptionKey: key,
+		Key:           "thing",
+		Thing:         thing,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var got Thing
+	if err := anystore.Unstash(&anystore.StashConfig{
+		Reader:        &buf,
+		GZip:          true,
+		EncryptionKey: key,
+		Key:           "thing",
+		Thing:         &got,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name == nil || *got.Name != *thing.Name || got.Description != thing.Description {
+		t.Errorf("expected %v, got %v", thing.Name, got.Name)
+	}
+}
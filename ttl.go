@@ -0,0 +1,120 @@
+package anystore
+
+import (
+	"encoding/gob"
+	"time"
+)
+
+// expiringValue wraps a value stored with a TTL. Expires is the expiry time in
+// nanoseconds since the Unix epoch. The wrapper is part of the persisted map
+// and therefore survives the (encrypted) GOB round trip, another instance
+// opening the persistence file respects the expiry.
+type expiringValue struct {
+	Value   any
+	Expires int64
+}
+
+func init() {
+	gob.Register(expiringValue{})
+}
+
+func (a *anyStore) StoreWithTTL(key any, value any, ttl time.Duration) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.storeWithTTL(key, value, ttl)
+}
+
+func (u *unsafeAnyStore) StoreWithTTL(key any, value any, ttl time.Duration) error {
+	return u.storeWithTTL(key, value, ttl)
+}
+
+func (a *anyStore) storeWithTTL(key any, value any, ttl time.Duration) error {
+	entry := a.expiring(value, ttl)
+	return a.mutate(func(kv anyMap) (bool, error) {
+		kv[key] = entry
+		return true, nil
+	})
+}
+
+// expiring wraps value in an expiringValue if ttl is above zero. A ttl of zero
+// uses the store's default TTL (Options.DefaultTTL), a negative ttl returns
+// value as is (never expires).
+func (a *anyStore) expiring(value any, ttl time.Duration) any {
+	if ttl == 0 {
+		ttl = time.Duration(a.ttl.Load())
+	}
+	if ttl <= 0 {
+		return value
+	}
+	return expiringValue{
+		Value:   value,
+		Expires: time.Now().Add(ttl).UnixNano(),
+	}
+}
+
+// unwrap returns the actual value of v and whether it has expired at now.
+func unwrap(v any, now int64) (value any, expired bool) {
+	if e, ok := v.(expiringValue); ok {
+		return e.Value, e.Expires <= now
+	}
+	return v, false
+}
+
+// load returns the value of key unless missing or expired at now.
+func (m anyMap) load(key any, now int64) (any, bool) {
+	v, ok := m[key]
+	if !ok {
+		return nil, false
+	}
+	value, expired := unwrap(v, now)
+	if expired {
+		return nil, false
+	}
+	return value, true
+}
+
+// len returns number of keys not expired at now.
+func (m anyMap) len(now int64) int {
+	n := 0
+	for _, v := range m {
+		if _, expired := unwrap(v, now); !expired {
+			n++
+		}
+	}
+	return n
+}
+
+// keys returns all keys not expired at now.
+func (m anyMap) keys(now int64) []any {
+	keys := make([]any, 0, len(m))
+	for k, v := range m {
+		if _, expired := unwrap(v, now); !expired {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// each calls f for each key and value not expired at now until f returns
+// false.
+func (m anyMap) each(now int64, f func(key, value any) bool) {
+	for k, v := range m {
+		value, expired := unwrap(v, now)
+		if expired {
+			continue
+		}
+		if !f(k, value) {
+			return
+		}
+	}
+}
+
+// purge deletes all keys expired at now. Must only be used on a map not yet
+// shared via atomic.Value.
+func (m anyMap) purge(now int64) {
+	for k, v := range m {
+		if _, expired := unwrap(v, now); expired {
+			delete(m, k)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package anystore_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_StoreWithTTL(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+		DefaultTTL:        50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("default", "expires"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StoreWithTTL("forever", "never expires", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StoreWithTTL("long", "expires later", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 3 {
+		t.Errorf("expected Len() == 3, got %d", l)
+	}
+	if v, err := a.Load("default"); err != nil {
+		t.Fatal(err)
+	} else if v != "expires" {
+		t.Errorf("expected value before expiry, got %v", v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if a.HasKey("default") {
+		t.Error("expected key to have expired")
+	}
+	if v, err := a.Load("default"); err != nil {
+		t.Fatal(err)
+	} else if v != nil {
+		t.Errorf("expected nil for expired key, got %v", v)
+	}
+	if keys, err := a.Keys(); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %v", keys)
+	}
+	if l, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 2 {
+		t.Errorf("expected Len() == 2, got %d", l)
+	}
+	// An expired key is absent for LoadOrStore.
+	if _, loaded, err := a.LoadOrStore("default", "again"); err != nil {
+		t.Fatal(err)
+	} else if loaded {
+		t.Error("expected LoadOrStore to store over expired key")
+	}
+}
+
+func TestAnyStore_StoreWithTTL_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-ttl-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	secret := anystore.NewKey()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.StoreWithTTL("token", strings.Repeat("x", 4096), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	fiBefore, err := os.Stat(tempfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance respects the expiry persisted in the file.
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.HasKey("token") {
+		t.Fatal("expected token before expiry")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b.HasKey("token") {
+		t.Error("expected token to have expired in other instance")
+	}
+	if l, err := b.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 1 {
+		t.Errorf("expected Len() == 1, got %d", l)
+	}
+	// Next write purges the expired entry from the file.
+	if err := b.Store("hola", "mundo"); err != nil {
+		t.Fatal(err)
+	}
+	fiAfter, err := os.Stat(tempfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fiAfter.Size() >= fiBefore.Size() {
+		t.Errorf("expected expired entry to be purged (size before %d, after %d)", fiBefore.Size(), fiAfter.Size())
+	}
+}
@@ -0,0 +1,77 @@
+package anystore
+
+import (
+	"reflect"
+	"time"
+)
+
+func (a *anyStore) Update(transaction func(tx AnyStore) error) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.update(transaction)
+}
+
+func (u *unsafeAnyStore) Update(transaction func(tx AnyStore) error) error {
+	return u.update(transaction)
+}
+
+// update is the non-locking implementation of Update.
+func (a *anyStore) update(transaction func(tx AnyStore) error) error {
+	var backend Backend
+	var state *persistenceCache
+	if a.persist.Load() {
+		var err error
+		backend, err = a.storage()
+		if err != nil {
+			return err
+		}
+		if err := backend.Lock(); err != nil {
+			return err
+		}
+		defer backend.Unlock()
+		state, err = a.readState(backend)
+		if err != nil {
+			return err
+		}
+		if kvO, ok := a.kv.Load().(anyMap); !ok || !sameMap(kvO, state.kv) {
+			a.setKV(state.kv)
+		}
+	}
+	kv := a.kv.Load().(anyMap)
+	tx := a.newTransaction(kv)
+	if err := transaction(tx); err != nil {
+		// Rollback, the staged map is simply discarded.
+		return err
+	}
+	// Commit
+	kvN := tx.kv.Load().(anyMap)
+	if reflect.ValueOf(kvN).Pointer() == reflect.ValueOf(kv).Pointer() {
+		// Read-only transaction, nothing to commit.
+		return nil
+	}
+	kvN.purge(time.Now().UnixNano())
+	if backend != nil {
+		if err := a.persistChanges(backend, state, kvN); err != nil {
+			return err
+		}
+	}
+	a.setKV(kvN)
+	return nil
+}
+
+// newTransaction returns an ephemeral (non-persisted) anyStore staging changes
+// on top of kv. As the underlying maps are copy-on-write, kv is never modified.
+func (a *anyStore) newTransaction(kv anyMap) *anyStore {
+	tx := new(anyStore)
+	tx.persist.Store(false)
+	tx.compression, tx.compressionLevel = a.compression, a.compressionLevel
+	tx.plaintext.Store(a.plaintext.Load())
+	tx.codec = a.codec
+	tx.ttl.Store(a.ttl.Load())
+	if keys, err := a.keys(); err == nil {
+		// Wipe on the transaction must not zero the key of the origin store.
+		tx.key.Store(keyRef{borrowedKeys{keys}})
+	}
+	tx.kv.Store(kv)
+	return tx
+}
@@ -0,0 +1,183 @@
+package anystore_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func TestAnyStore_Update_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-update-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rollback
+	errTesting := errors.New("this error")
+	err = a.Update(func(tx anystore.AnyStore) error {
+		if err := tx.Store("hola", "mundo"); err != nil {
+			return err
+		}
+		if err := tx.Delete("hello"); err != nil {
+			return err
+		}
+		if !tx.HasKey("hola") || tx.HasKey("hello") {
+			t.Error("expected staged changes to be visible inside the transaction")
+		}
+		return errTesting
+	})
+	if err != errTesting {
+		t.Errorf("expected error %v, got %v", errTesting, err)
+	}
+	if a.HasKey("hola") || !a.HasKey("hello") {
+		t.Error("expected changes to be discarded on error")
+	}
+
+	// Commit
+	err = a.Update(func(tx anystore.AnyStore) error {
+		if err := tx.Store("hola", "mundo"); err != nil {
+			return err
+		}
+		return tx.Delete("hello")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.HasKey("hola") || b.HasKey("hello") {
+		t.Error("expected committed changes in persistence file")
+	}
+}
+
+func TestAnyStore_Update_concurrent(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-update-concurrent-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	const workers = 4
+	const increments = 10
+	errch := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			a, err := anystore.NewAnyStore(&anystore.Options{
+				EnablePersistence: true,
+				PersistenceFile:   tempfile,
+			})
+			if err != nil {
+				errch <- err
+				return
+			}
+			for i := 0; i < increments; i++ {
+				// Read-modify-write of two keys, atomic across instances.
+				if err := a.Update(func(tx anystore.AnyStore) error {
+					v, err := tx.Load("counter")
+					if err != nil {
+						return err
+					}
+					n, _ := v.(int)
+					if err := tx.Store("counter", n+1); err != nil {
+						return err
+					}
+					return tx.Store("shadow", n+1)
+				}); err != nil {
+					errch <- err
+					return
+				}
+			}
+			errch <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := anystore.NewTypedStore[string, int](&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.Update(func(tx *anystore.TypedStore[string, int]) error {
+		counter, err := tx.Load("counter")
+		if err != nil {
+			return err
+		}
+		shadow, err := tx.Load("shadow")
+		if err != nil {
+			return err
+		}
+		if counter != workers*increments || shadow != counter {
+			t.Errorf("expected counter == shadow == %d, got %d and %d", workers*increments, counter, shadow)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnyStore_Update_wipe(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "wipe"),
+		EncryptionKey:     anystore.NewKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	key := append([]byte(nil), a.GetEncryptionKeyBytes()...)
+	if err := a.Update(func(tx anystore.AnyStore) error {
+		tx.Wipe()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Wiping the transaction leaves the key of the store intact.
+	if !bytes.Equal(a.GetEncryptionKeyBytes(), key) {
+		t.Error("expected the key of the store to be intact")
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Load("hello"); err != nil {
+		t.Fatal(err)
+	} else if v != "world" {
+		t.Errorf("expected world, got %v", v)
+	}
+}
@@ -0,0 +1,257 @@
+package anystore
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyTypeMismatch   error = errors.New("key type does not match TypedStore key type")
+	ErrValueTypeMismatch error = errors.New("value type does not match TypedStore value type")
+)
+
+// TypedStore is a generic facade over AnyStore where keys are of type K and
+// values of type V. Load returns a V instead of an interface (any) requiring a
+// type assertion. TypedStore uses an AnyStore underneath and therefore share
+// persistence, gzip and encryption options with it. Must be initialized using
+// NewTypedStore or Typed.
+type TypedStore[K comparable, V any] struct {
+	store AnyStore
+}
+
+// NewTypedStore returns an initialized TypedStore using a new AnyStore
+// configured via Options o.
+func NewTypedStore[K comparable, V any](o *Options) (*TypedStore[K, V], error) {
+	a, err := NewAnyStore(o)
+	if err != nil {
+		return nil, err
+	}
+	return Typed[K, V](a), nil
+}
+
+// Typed wraps an existing AnyStore in a TypedStore. The concrete types of K and
+// V are registered with encoding/gob in order to be persisted as interface
+// values in the underlying map. Typed panics if another type is registered
+// with encoding/gob under the name of K or V.
+func Typed[K comparable, V any](a AnyStore) *TypedStore[K, V] {
+	var k K
+	var v V
+	gobRegister(k)
+	gobRegister(v)
+	return &TypedStore[K, V]{store: a}
+}
+
+// AnyStore returns the underlying AnyStore.
+func (t *TypedStore[K, V]) AnyStore() AnyStore {
+	return t.store
+}
+
+// HasKey tests if key exists in the store.
+func (t *TypedStore[K, V]) HasKey(key K) bool {
+	return t.store.HasKey(key)
+}
+
+// Load retrieves the value of key. If key is not in the store, Load returns
+// the zero value of V. If the stored value is not of type V, Load returns an
+// error wrapping ErrValueTypeMismatch.
+func (t *TypedStore[K, V]) Load(key K) (V, error) {
+	var zero V
+	value, err := t.store.Load(key)
+	if err != nil {
+		return zero, err
+	}
+	return t.assert(key, value)
+}
+
+// Store adds or replaces a key/value pair in the store.
+func (t *TypedStore[K, V]) Store(key K, value V) error {
+	return t.store.Store(key, value)
+}
+
+// StoreWithTTL adds or replaces a key/value pair in the store that expires
+// after ttl, see AnyStore.StoreWithTTL.
+func (t *TypedStore[K, V]) StoreWithTTL(key K, value V, ttl time.Duration) error {
+	return t.store.StoreWithTTL(key, value, ttl)
+}
+
+// Delete removes a key from the store.
+func (t *TypedStore[K, V]) Delete(key K) error {
+	return t.store.Delete(key)
+}
+
+// StoreMany adds or replaces all key/value pairs in kv, see
+// AnyStore.StoreMany.
+func (t *TypedStore[K, V]) StoreMany(kv map[K]V) error {
+	m := make(map[any]any, len(kv))
+	for k, v := range kv {
+		m[k] = v
+	}
+	return t.store.StoreMany(m)
+}
+
+// DeleteMany removes all keys from the store, see AnyStore.DeleteMany.
+func (t *TypedStore[K, V]) DeleteMany(keys []K) error {
+	k := make([]any, 0, len(keys))
+	for _, key := range keys {
+		k = append(k, key)
+	}
+	return t.store.DeleteMany(k)
+}
+
+// CompareAndSwap swaps the old and new values for key if the value stored is
+// equal to old, see AnyStore.CompareAndSwap.
+func (t *TypedStore[K, V]) CompareAndSwap(key K, old, new V) (bool, error) {
+	return t.store.CompareAndSwap(key, old, new)
+}
+
+// CompareAndDelete deletes the entry for key if its value is equal to old, see
+// AnyStore.CompareAndDelete.
+func (t *TypedStore[K, V]) CompareAndDelete(key K, old V) (bool, error) {
+	return t.store.CompareAndDelete(key, old)
+}
+
+// LoadOrStore returns the existing value for key if present. Otherwise, it
+// stores and returns the given value, see AnyStore.LoadOrStore.
+func (t *TypedStore[K, V]) LoadOrStore(key K, value V) (V, bool, error) {
+	actual, loaded, err := t.store.LoadOrStore(key, value)
+	if err != nil {
+		return value, false, err
+	}
+	v, err := t.assert(key, actual)
+	return v, loaded, err
+}
+
+// LoadAndDelete deletes the value for key, returning the previous value if
+// any, see AnyStore.LoadAndDelete.
+func (t *TypedStore[K, V]) LoadAndDelete(key K) (V, bool, error) {
+	value, loaded, err := t.store.LoadAndDelete(key)
+	if err != nil || !loaded {
+		var zero V
+		return zero, loaded, err
+	}
+	v, err := t.assert(key, value)
+	return v, loaded, err
+}
+
+// Swap stores value for key and returns the previous value if any, see
+// AnyStore.Swap.
+func (t *TypedStore[K, V]) Swap(key K, value V) (V, bool, error) {
+	previous, loaded, err := t.store.Swap(key, value)
+	if err != nil || !loaded {
+		var zero V
+		return zero, loaded, err
+	}
+	v, err := t.assert(key, previous)
+	return v, loaded, err
+}
+
+// Len returns number of keys in the store.
+func (t *TypedStore[K, V]) Len() (int, error) {
+	return t.store.Len()
+}
+
+// Keys returns a slice with all keys in the store. If a key in the underlying
+// AnyStore is not of type K, Keys returns an error wrapping ErrKeyTypeMismatch.
+func (t *TypedStore[K, V]) Keys() ([]K, error) {
+	keys, err := t.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	typedKeys := make([]K, 0, len(keys))
+	for _, key := range keys {
+		k, ok := key.(K)
+		if !ok {
+			return nil, fmt.Errorf("%w: key %v is %T, not %s", ErrKeyTypeMismatch, key, key, typeName[K]())
+		}
+		typedKeys = append(typedKeys, k)
+	}
+	return typedKeys, nil
+}
+
+// Range calls f sequentially for each key and value in the store, see
+// AnyStore.Range. If a key or value is not of type K or V, Range stops and
+// returns an error wrapping ErrKeyTypeMismatch or ErrValueTypeMismatch. A nil
+// value is passed as the zero value of V (like Load).
+func (t *TypedStore[K, V]) Range(f func(key K, value V) bool) error {
+	var err error
+	if rangeErr := t.store.Range(func(key, value any) bool {
+		k, ok := key.(K)
+		if !ok {
+			err = fmt.Errorf("%w: key %v is %T, not %s", ErrKeyTypeMismatch, key, key, typeName[K]())
+			return false
+		}
+		v, assertErr := t.assert(k, value)
+		if assertErr != nil {
+			err = assertErr
+			return false
+		}
+		return f(k, v)
+	}); rangeErr != nil {
+		return rangeErr
+	}
+	return err
+}
+
+// Run executes atomicOperation exclusively by locking the underlying store,
+// see AnyStore.Run. You have to use the TypedStore passed as argument to
+// atomicOperation or the operation will deadlock.
+func (t *TypedStore[K, V]) Run(atomicOperation func(s *TypedStore[K, V]) error) error {
+	return t.store.Run(func(s AnyStore) error {
+		return atomicOperation(&TypedStore[K, V]{store: s})
+	})
+}
+
+// Update executes transaction in a read-write transaction, see
+// AnyStore.Update. Changes are only persisted if transaction returns nil.
+func (t *TypedStore[K, V]) Update(transaction func(tx *TypedStore[K, V]) error) error {
+	return t.store.Update(func(tx AnyStore) error {
+		return transaction(&TypedStore[K, V]{store: tx})
+	})
+}
+
+// Close closes the underlying AnyStore.
+func (t *TypedStore[K, V]) Close() error {
+	return t.store.Close()
+}
+
+// assert type-asserts value (of key) into V. A nil value returns the zero
+// value of V.
+func (t *TypedStore[K, V]) assert(key K, value any) (V, error) {
+	var zero V
+	if value == nil {
+		return zero, nil
+	}
+	v, ok := value.(V)
+	if !ok {
+		return zero, fmt.Errorf("%w: key %v holds %T, not %s", ErrValueTypeMismatch, key, value, typeName[V]())
+	}
+	return v, nil
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
+
+// gobRegister registers the concrete type of v with encoding/gob. Interface
+// types (nil v) are skipped. A type already registered under another name
+// (e.g using gob.RegisterName) is left as is, any other panic (e.g another
+// type registered under the name of v's type) is re-raised as values of the
+// type could not be persisted.
+func gobRegister(v any) {
+	if v == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if msg, ok := r.(string); ok && strings.HasPrefix(msg, "gob: registering duplicate names for ") {
+				return
+			}
+			panic(r)
+		}
+	}()
+	gob.Register(v)
+}
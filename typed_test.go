@@ -0,0 +1,218 @@
+package anystore_test
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sa6mwa/anystore"
+)
+
+type typedThing struct {
+	Name   string
+	Number int
+}
+
+func TestTypedStore(t *testing.T) {
+	ts, err := anystore.NewTypedStore[string, int](&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Store("one", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Store("two", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ts.Load("two"); err != nil {
+		t.Fatal(err)
+	} else if v != 2 {
+		t.Errorf("expected 2, got %d", v)
+	}
+	if v, err := ts.Load("keyNotPresent"); err != nil {
+		t.Fatal(err)
+	} else if v != 0 {
+		t.Errorf("expected zero value, got %d", v)
+	}
+	keys, err := ts.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"one", "two"}) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if err := ts.Delete("one"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.HasKey("one") {
+		t.Error("expected key one to be deleted")
+	}
+	if l, err := ts.Len(); err != nil {
+		t.Fatal(err)
+	} else if l != 1 {
+		t.Errorf("expected Len() == 1, got %d", l)
+	}
+	if err := ts.Run(func(s *anystore.TypedStore[string, int]) error {
+		v, err := s.Load("two")
+		if err != nil {
+			return err
+		}
+		return s.Store("two", v+1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ts.Load("two"); err != nil {
+		t.Fatal(err)
+	} else if v != 3 {
+		t.Errorf("expected 3, got %d", v)
+	}
+}
+
+func TestTypedStore_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-typed-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	secret := anystore.NewKey()
+	ts, err := anystore.NewTypedStore[string, *typedThing](&anystore.Options{
+		EnablePersistence:   true,
+		PersistenceFile:     tempfile,
+		GZipPersistenceFile: true,
+		EncryptionKey:       secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	expected := &typedThing{Name: "hello", Number: 42}
+	if err := ts.Store("thing", expected); err != nil {
+		t.Fatal(err)
+	}
+	other, err := anystore.NewTypedStore[string, *typedThing](&anystore.Options{
+		EnablePersistence:   true,
+		PersistenceFile:     tempfile,
+		GZipPersistenceFile: true,
+		EncryptionKey:       secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := other.Load("thing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestTypedStore_typeMismatch(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store(123, 456); err != nil {
+		t.Fatal(err)
+	}
+	ts := anystore.Typed[string, int](a)
+	if _, err := ts.Load("hello"); !errors.Is(err, anystore.ErrValueTypeMismatch) {
+		t.Errorf("expected ErrValueTypeMismatch, got %v", err)
+	}
+	if _, err := ts.Keys(); !errors.Is(err, anystore.ErrKeyTypeMismatch) {
+		t.Errorf("expected ErrKeyTypeMismatch, got %v", err)
+	}
+}
+
+func TestTypedStore_Range(t *testing.T) {
+	ts, err := anystore.NewTypedStore[string, int](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := ts.Store(k, len(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	if err := ts.Range(func(key string, value int) bool {
+		n += value
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+	if err := ts.AnyStore().Store("d", "not an int"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Range(func(key string, value int) bool {
+		return true
+	}); !errors.Is(err, anystore.ErrValueTypeMismatch) {
+		t.Errorf("expected ErrValueTypeMismatch, got %v", err)
+	}
+}
+
+func TestTypedStore_RangeNil(t *testing.T) {
+	ts, err := anystore.NewTypedStore[string, *Thing](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.AnyStore().Store("nil", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Range treats a nil value like Load, as the zero value of V.
+	if v, err := ts.Load("nil"); err != nil || v != nil {
+		t.Errorf("expected nil, got %v, %v", v, err)
+	}
+	visited := 0
+	if err := ts.Range(func(key string, value *Thing) bool {
+		visited++
+		if value != nil {
+			t.Errorf("expected nil, got %v", value)
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 1 {
+		t.Errorf("expected 1 key, got %d", visited)
+	}
+}
+
+type renamedValue struct{ A int }
+
+type collidingValue struct{ A int }
+
+type otherValue struct{ B string }
+
+func TestTyped_gobRegister(t *testing.T) {
+	// A type registered under another name is accepted.
+	gob.RegisterName("renamed", renamedValue{})
+	anystore.Typed[string, renamedValue](nil)
+	// Another type registered under the name of V is not.
+	gob.RegisterName("github.com/sa6mwa/anystore_test.collidingValue", otherValue{})
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on a gob name collision")
+		}
+	}()
+	anystore.Typed[string, collidingValue](nil)
+}
@@ -0,0 +1,217 @@
+package anystore
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultWatchInterval is how often the persistence file is checked for
+// changes made by other processes when there are active watchers and
+// Options.WatchInterval is omitted.
+const DefaultWatchInterval time.Duration = 250 * time.Millisecond
+
+// Event describes a change to a key in the store delivered by AnyStore.Watch.
+// OldValue is nil for a new key and NewValue is nil when Op is OpDelete. An
+// expired key is reported as deleted once it is purged from the store.
+type Event struct {
+	Key      any
+	OldValue any
+	NewValue any
+	Op       OpType
+}
+
+// watchHub keeps track of watchers of an anyStore and the poller detecting
+// changes to the persistence file made by other processes. The zero value is
+// ready to use.
+type watchHub struct {
+	mutex      sync.Mutex
+	watchers   map[*watcher]struct{}
+	stopPoller context.CancelFunc
+}
+
+type watcher struct {
+	keys   map[any]struct{}
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	queue  []Event
+	signal chan struct{}
+	out    chan Event
+}
+
+func (a *anyStore) Watch(ctx context.Context, keys ...any) <-chan Event {
+	w := &watcher{
+		signal: make(chan struct{}, 1),
+		out:    make(chan Event),
+	}
+	if len(keys) > 0 {
+		w.keys = make(map[any]struct{}, len(keys))
+		for _, k := range keys {
+			w.keys[k] = struct{}{}
+		}
+	}
+	ctx, w.cancel = context.WithCancel(ctx)
+	a.watch.mutex.Lock()
+	if a.watch.watchers == nil {
+		a.watch.watchers = make(map[*watcher]struct{})
+	}
+	a.watch.watchers[w] = struct{}{}
+	if a.watch.stopPoller == nil {
+		var pollerCtx context.Context
+		pollerCtx, a.watch.stopPoller = context.WithCancel(context.Background())
+		go a.poll(pollerCtx)
+	}
+	a.watch.mutex.Unlock()
+	go func() {
+		defer a.watch.remove(w)
+		w.run(ctx)
+	}()
+	return w.out
+}
+
+// setKV atomically replaces the map of the store and notifies watchers of
+// the differences between the previous and the new map. All changes (either
+// made in-process or loaded from the persistence file) pass through setKV.
+func (a *anyStore) setKV(kvN anyMap) {
+	kvO, _ := a.kv.Swap(kvN).(anyMap)
+	a.watch.notify(kvO, kvN)
+}
+
+// poll periodically checks if the Version of the persistence file has changed
+// and loads it to notify watchers of
+// changes made by other processes.
+func (a *anyStore) poll(ctx context.Context) {
+	interval := time.Duration(a.watchInterval.Load())
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last Version
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !a.persist.Load() {
+			continue
+		}
+		backend, err := a.storage()
+		if err != nil {
+			continue
+		}
+		version, err := backend.Version()
+		if err != nil || version == last {
+			continue
+		}
+		a.mutex.Lock()
+		if err := a.load(); err == nil {
+			last = version
+		}
+		a.mutex.Unlock()
+	}
+}
+
+func (h *watchHub) notify(kvO, kvN anyMap) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	events := diff(kvO, kvN, time.Now().UnixNano())
+	if len(events) == 0 {
+		return
+	}
+	for w := range h.watchers {
+		w.push(events)
+	}
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.watchers, w)
+	if len(h.watchers) == 0 && h.stopPoller != nil {
+		h.stopPoller()
+		h.stopPoller = nil
+	}
+}
+
+// close cancels all watchers and stops the poller.
+func (h *watchHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for w := range h.watchers {
+		w.cancel()
+	}
+	if h.stopPoller != nil {
+		h.stopPoller()
+		h.stopPoller = nil
+	}
+}
+
+// push queues events matching the watcher's keys without blocking, events
+// are delivered in order by run.
+func (w *watcher) push(events []Event) {
+	w.mutex.Lock()
+	for _, e := range events {
+		if w.keys != nil {
+			if _, ok := w.keys[e.Key]; !ok {
+				continue
+			}
+		}
+		w.queue = append(w.queue, e)
+	}
+	w.mutex.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.out)
+	for {
+		w.mutex.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+		for _, e := range queue {
+			select {
+			case w.out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-w.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// diff returns events describing the changes from kvO to kvN at now. Expired
+// keys are considered absent.
+func diff(kvO, kvN anyMap, now int64) []Event {
+	var events []Event
+	kvN.each(now, func(key, value any) bool {
+		old, ok := kvO.load(key, now)
+		switch {
+		case !ok:
+			events = append(events, Event{Key: key, NewValue: value, Op: OpStore})
+		case !reflect.DeepEqual(old, value):
+			events = append(events, Event{Key: key, OldValue: old, NewValue: value, Op: OpStore})
+		}
+		return true
+	})
+	kvO.each(now, func(key, value any) bool {
+		if _, ok := kvN.load(key, now); !ok {
+			events = append(events, Event{Key: key, OldValue: value, Op: OpDelete})
+		}
+		return true
+	})
+	return events
+}
@@ -0,0 +1,168 @@
+package anystore_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sa6mwa/anystore"
+)
+
+func receive(t *testing.T, events <-chan anystore.Event) anystore.Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("watch channel closed unexpectedly")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return anystore.Event{}
+}
+
+func TestAnyStore_Watch(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	all := a.Watch(ctx)
+	hello := a.Watch(ctx, "hello")
+
+	if err := a.Store("hola", "mundo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	// Storing an equal value is not a change, no Event is emitted.
+	if err := a.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Store("hello", "there"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []anystore.Event{
+		{Key: "hola", NewValue: "mundo", Op: anystore.OpStore},
+		{Key: "hello", NewValue: "world", Op: anystore.OpStore},
+		{Key: "hello", OldValue: "world", NewValue: "there", Op: anystore.OpStore},
+		{Key: "hello", OldValue: "there", Op: anystore.OpDelete},
+	}
+	for _, want := range expected {
+		if got := receive(t, all); got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+	for _, want := range expected[1:] {
+		if got := receive(t, hello); got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+	cancel()
+	for range all {
+	}
+	for range hello {
+	}
+}
+
+func TestAnyStore_Watch_persisted(t *testing.T) {
+	f, err := os.CreateTemp("", "anystore-test-watch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile := f.Name()
+	f.Close()
+	defer func() {
+		os.Remove(tempfile)
+		os.Remove(tempfile + ".lock")
+	}()
+	secret := anystore.NewKey()
+	watching, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+		WatchInterval:     10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := watching.Watch(context.Background(), "hello")
+
+	// Another instance (emulating another process) sharing the persistence
+	// file.
+	other, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   tempfile,
+		EncryptionKey:     secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Store("hello", "world"); err != nil {
+		t.Fatal(err)
+	}
+	want := anystore.Event{Key: "hello", NewValue: "world", Op: anystore.OpStore}
+	if got := receive(t, events); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if _, _, err := other.LoadAndDelete("hello"); err != nil {
+		t.Fatal(err)
+	}
+	want = anystore.Event{Key: "hello", OldValue: "world", Op: anystore.OpDelete}
+	if got := receive(t, events); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if err := watching.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected no more events after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected watch channel to be closed by Close")
+	}
+}
+
+func TestAnyStore_Watch_failedSave(t *testing.T) {
+	a, err := anystore.NewAnyStore(&anystore.Options{
+		EnablePersistence: true,
+		PersistenceFile:   filepath.Join(t.TempDir(), "watch"),
+		Codec:             anystore.JSONCodec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := a.Watch(ctx)
+	type structKey struct{ A int }
+	if err := a.Store(structKey{1}, "x"); !errors.Is(err, anystore.ErrCodecKeyType) {
+		t.Fatalf("expected ErrCodecKeyType, got %v", err)
+	}
+	if err := a.Store("saved", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// The failed save is neither notified nor kept in memory.
+	want := anystore.Event{Key: "saved", NewValue: "value", Op: anystore.OpStore}
+	if got := receive(t, events); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if n, err := a.Len(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected 1 key, got %d", n)
+	}
+}